@@ -0,0 +1,76 @@
+package main
+
+import "sync/atomic"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The packets passed to queuePacket point directly into the receive buffer
+ * for the queue, which is reused for the next recv as soon as the packets
+ * in it have been handled. Every dispatchPacket holds a reference to the
+ * bufferHolder for the buffer it came from, and the receive loop holds
+ * one more. If a handler that missed its deadline is still running when
+ * the receive loop is done with the buffer, the receive loop uses a new
+ * buffer and the free function, if any, is called when the last reference
+ * is released.
+ */
+type bufferHolder struct {
+	free func()
+	refs int32
+}
+
+// each entry is only used by the netfilter thread for the matching queue
+var currentBuffer []*bufferHolder
+
+/*---------------------------------------------------------------------------*/
+func bufferStartup(count int) {
+	currentBuffer = make([]*bufferHolder, count)
+	for i := range currentBuffer {
+		currentBuffer[i] = newBufferHolder()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func newBufferHolder() *bufferHolder {
+	holder := new(bufferHolder)
+	holder.refs = 1
+	return (holder)
+}
+
+/*---------------------------------------------------------------------------*/
+func (holder *bufferHolder) retain() {
+	atomic.AddInt32(&holder.refs, 1)
+}
+
+/*---------------------------------------------------------------------------*/
+func (holder *bufferHolder) release() {
+	if (atomic.AddInt32(&holder.refs, -1) == 0) && (holder.free != nil) {
+		holder.free()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Called by the queue source after each buffer has been processed. We drop
+ * the reference held by the receive loop and return false if nothing else
+ * is using the buffer so it can be reused. Otherwise we keep the buffer and
+ * return true so the source will allocate a new one. A source that must
+ * free the buffer sets the free function before calling.
+ */
+func bufferRetained(index int) bool {
+	holder := currentBuffer[index]
+
+	if atomic.AddInt32(&holder.refs, -1) == 0 {
+		holder.free = nil
+		holder.refs = 1
+		return false
+	}
+
+	support.IncrementCounter("netfilter.retained")
+	currentBuffer[index] = newBufferHolder()
+	return true
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,83 @@
+package main
+
+import "bytes"
+import "time"
+import "testing"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * A handler that misses the deadline while it is running must never see the
+ * buffer change under it, which the race detector also checks since the
+ * receive loop would write the next packet into the same memory.
+ */
+func TestLateHandlerBuffer(t *testing.T) {
+	queue, _, _ := testBackend(t)
+	started := make(chan []byte, 1)
+	release := make(chan bool)
+	result := make(chan bool, 1)
+
+	setHandler(t, func(ctx *support.PacketContext) support.Verdict {
+		if ctx.Tuple.ClientPort == 41001 {
+			started <- append([]byte(nil), ctx.Buffer...)
+			<-release
+			result <- bytes.Equal(ctx.Buffer, <-started)
+		}
+		return (support.Verdict{Action: support.VerdictAccept})
+	})
+
+	queue.Inject(0, 0, testPacket(t, "10.2.0.1", 41001, "10.2.0.2", 53))
+	original := <-started
+	started <- original
+
+	// the next packet must go into a new receive buffer
+	queue.Inject(0, 0, testPacket(t, "10.2.0.3", 41002, "10.2.0.4", 123))
+	close(release)
+
+	if !<-result {
+		t.Errorf("the buffer changed while a late handler was using it")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * A handler that has not started when the verdict is issued is never called
+ * for the packet, so it can not read a buffer that has been reused.
+ */
+func TestCancelledHandler(t *testing.T) {
+	queue, _, _ := testBackend(t)
+	release := make(chan bool)
+	calls := make(chan uint16, 4)
+
+	setHandler(t, func(ctx *support.PacketContext) support.Verdict {
+		calls <- ctx.Tuple.ClientPort
+		<-release
+		return (support.Verdict{Action: support.VerdictAccept})
+	})
+
+	skipped := support.GetCounters()["plugin.test.skipped"]
+
+	// the first two packets keep both dispatch workers busy
+	queue.Inject(0, 0, testPacket(t, "10.3.0.1", 42001, "10.3.0.2", 53))
+	queue.Inject(0, 0, testPacket(t, "10.3.0.1", 42002, "10.3.0.2", 53))
+	queue.Inject(0, 0, testPacket(t, "10.3.0.1", 42003, "10.3.0.2", 53))
+	close(release)
+
+	for i := 0; (i < 100) && (support.GetCounters()["plugin.test.skipped"] == skipped); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if support.GetCounters()["plugin.test.skipped"] != skipped+1 {
+		t.Errorf("the queued handler was not skipped")
+	}
+
+	for len(calls) > 0 {
+		if <-calls == 42003 {
+			t.Errorf("the handler was called after the verdict")
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -1,66 +1,114 @@
 package certcache
 
 import "fmt"
+import "net"
 import "sync"
+import "time"
 import "crypto/tls"
 import "crypto/x509"
 import "github.com/untangle/packetd/support"
 
 var localMutex sync.Mutex
+var pendingTable = make(map[string][]*support.SessionEntry)
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Startup(childsync *sync.WaitGroup) {
+type Plugin struct {
+}
+
+/*---------------------------------------------------------------------------*/
+func (p *Plugin) Name() string {
+	return ("certcache")
+}
+
+/*---------------------------------------------------------------------------*/
+func (p *Plugin) Startup(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Startup(%s) has been called\n", "certcache")
 	childsync.Add(1)
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Goodbye(childsync *sync.WaitGroup) {
+func (p *Plugin) Goodbye(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Goodbye(%s) has been called\n", "certcache")
 	childsync.Done()
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_netfilter_handler(ch chan<- int32, tuple support.Tuple) {
+func (p *Plugin) NetfilterHandler(ctx *support.PacketContext) support.Verdict {
+	tuple := ctx.Session.SessionTuple
 
+	// we only care about HTTPS sessions
 	if tuple.ServerPort != 443 {
-		return
+		return (support.Verdict{Action: support.VerdictAccept, Release: true})
 	}
 
-	localMutex.Lock()
-
-	var cert x509.Certificate
-	var ok bool
-
 	client := fmt.Sprintf("%s", tuple.ClientAddr)
+	server := fmt.Sprintf("%s", tuple.ServerAddr)
 
 	// TODO - remove this hack once we can ignore locally generated traffic
 	if client == "192.168.222.20" {
-		return
+		return (support.Verdict{Action: support.VerdictAccept, Release: true})
 	}
 
-	if cert, ok = support.FindCertificate(client); ok {
-		support.LogMessage("Loading certificate for %s\n", tuple.ServerAddr)
+	localMutex.Lock()
+
+	if cert, ok := support.FindCertificate(server); ok {
+		support.LogMessage("Loading certificate for %s\n", server)
+		ctx.Session.SetServerCertificate(cert)
+		support.LogMessage("CERTIFICATE: %s\n", cert.Subject)
+	} else if list, ok := pendingTable[server]; ok {
+		// a fetch is already running so just wait for the result
+		pendingTable[server] = append(list, ctx.Session)
 	} else {
-		support.LogMessage("Fetching certificate for %s\n", tuple.ServerAddr)
+		// fetch the certificate in the background so we never block the queue
+		pendingTable[server] = []*support.SessionEntry{ctx.Session}
+		go fetchCertificate(server)
+	}
 
-		conf := &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	localMutex.Unlock()
 
-		target := fmt.Sprintf("%s:443", tuple.ServerAddr)
-		conn, err := tls.Dial("tcp", target, conf)
-		if err != nil {
-			support.LogMessage("TLS ERROR: %s\n", err)
-		}
+	// the fetch will store the certificate in the session so we can release it
+	return (support.Verdict{Action: support.VerdictAccept, Release: true})
+}
+
+/*---------------------------------------------------------------------------*/
+func fetchCertificate(server string) {
+	var cert x509.Certificate
+	var found bool
+
+	support.LogMessage("Fetching certificate for %s\n", server)
+
+	conf := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+	}
 
-		cert = *conn.ConnectionState().PeerCertificates[0]
-		support.InsertCertificate(client, cert)
+	target := net.JoinHostPort(server, "443")
+	conn, err := tls.DialWithDialer(dialer, "tcp", target, conf)
+	if err != nil {
+		support.LogMessage("TLS ERROR: %s\n", err)
+	} else {
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) != 0 {
+			cert = *certs[0]
+			found = true
+		}
 		conn.Close()
 	}
 
+	localMutex.Lock()
+
+	if found {
+		support.InsertCertificate(server, cert)
+		support.LogMessage("CERTIFICATE: %s\n", cert.Subject)
+		for _, entry := range pendingTable[server] {
+			entry.SetServerCertificate(cert)
+		}
+	}
+
+	delete(pendingTable, server)
 	localMutex.Unlock()
-	support.LogMessage("CERTIFICATE: %s\n", cert.Subject)
 }
 
 /*---------------------------------------------------------------------------*/
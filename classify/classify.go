@@ -20,29 +20,58 @@ import "sync"
 
 import "github.com/untangle/packetd/support"
 
+var markField support.MarkField
+
+/*---------------------------------------------------------------------------*/
+type Plugin struct {
+}
+
 /*---------------------------------------------------------------------------*/
-func Plugin_Startup(childsync *sync.WaitGroup) {
+func (p *Plugin) Name() string {
+	return ("classify")
+}
+
+/*---------------------------------------------------------------------------*/
+func (p *Plugin) Startup(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Startup(%s) has been called\n", "classify")
+
+	var err error
+	markField, err = support.AllocateMark(p.Name(), "classify", 17, 1)
+	if err != nil {
+		support.LogMessage("Unable to allocate mark field: %s\n", err)
+	}
+
 	childsync.Add(1)
 	C.vendor_startup()
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Goodbye(childsync *sync.WaitGroup) {
+func (p *Plugin) Goodbye(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Goodbye(%s) has been called\n", "classify")
+	support.FreeMarks(p.Name())
 	C.vendor_shutdown()
 	childsync.Done()
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_netfilter_handler(ch chan<- int32, buffer []byte, length int) {
-	ptr := (*C.uchar)(unsafe.Pointer(&buffer[0]))
-	C.vendor_classify(ptr, C.int(length))
+func (p *Plugin) NetfilterHandler(ctx *support.PacketContext) support.Verdict {
+	ptr := (*C.uchar)(unsafe.Pointer(&ctx.Buffer[0]))
+	state := C.vendor_classify(ptr, C.int(ctx.Length))
 
 	// TODO - put the classification in the session object
 
-	// use the channel to return our mark bits
-	ch <- 2
+	// accept the packet and return our mark bits
+	var verdict support.Verdict
+	verdict.Action = support.VerdictAccept
+	verdict.Mark = markField.Value(1)
+	verdict.Mask = markField.Mask
+
+	// once the classification is final we don't need any more packets
+	if (state == C.NAVL_STATE_CLASSIFIED) || (state == C.NAVL_STATE_TERMINATED) {
+		verdict.Release = true
+	}
+
+	return (verdict)
 }
 
 /*---------------------------------------------------------------------------*/
@@ -67,6 +67,9 @@ protochain[0] = 0;
 // TODO - do something with the appname and protochain
 printf("APPNAME:%s PROTOCHAIN:%s\n",appname,protochain);
 
+// pass the classification state back to vendor_classify
+if (arg != NULL) *(int *)arg = state;
+
 return(0);
 }
 /*--------------------------------------------------------------------------*/
@@ -102,7 +105,12 @@ printf("DETAIL:%s\n",detail);
 /*--------------------------------------------------------------------------*/
 int vendor_classify(const unsigned char *data,int length)
 {
-navl_classify(l_navl_handle,NAVL_ENCAP_IP,data,length,NULL,0,navl_callback,NULL);
+int		state;
+
+// the callback will update the state with the classification result
+state = NAVL_STATE_INSPECTING;
+navl_classify(l_navl_handle,NAVL_ENCAP_IP,data,length,NULL,0,navl_callback,&state);
+return(state);
 }
 /*--------------------------------------------------------------------------*/
 int vendor_log_message(const char *level, const char *func, const char *format, ... )
@@ -8,6 +8,8 @@
  */
 
 #include <unistd.h>
+#include <sched.h>
+#include <pthread.h>
 #include <syslog.h>
 #include <stdlib.h>
 #include <stdarg.h>
@@ -18,9 +20,11 @@
 #include <sys/time.h>
 #include <arpa/inet.h>
 #include <netinet/ip.h>
+#include <netinet/ip6.h>
 #include <netinet/tcp.h>
 #include <netinet/udp.h>
 #include <netinet/ip_icmp.h>
+#include <netinet/icmp6.h>
 #include <linux/netfilter.h>
 #include <libnetfilter_conntrack/libnetfilter_conntrack.h>
 #include <libnetfilter_queue/libnetfilter_queue.h>
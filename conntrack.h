@@ -11,22 +11,34 @@
 struct conntrack_info
 {
 	u_int8_t	msg_type;
+	u_int8_t	orig_family;
 	u_int8_t	orig_proto;
-	u_int32_t	orig_saddr;
-	u_int32_t	orig_daddr;
+	u_int8_t	orig_saddr[16];
+	u_int8_t	orig_daddr[16];
 	u_int16_t	orig_sport;
 	u_int16_t	orig_dport;
+	u_int8_t	repl_saddr[16];
+	u_int8_t	repl_daddr[16];
+	u_int16_t	repl_sport;
+	u_int16_t	repl_dport;
+	u_int64_t	orig_packets;
 	u_int64_t	orig_bytes;
+	u_int64_t	repl_packets;
 	u_int64_t	repl_bytes;
+	u_int8_t	has_counters;
+	u_int32_t	mark;
+	u_int16_t	zone;
+	u_int32_t	status;
+	u_int8_t	tcp_state;
+	u_int32_t	timeout;
 };
 /*--------------------------------------------------------------------------*/
 extern void go_conntrack_callback(struct conntrack_info* info);
-extern void go_child_startup(void);
-extern void go_child_goodbye(void);
 /*--------------------------------------------------------------------------*/
 static struct nfct_handle	*nfcth;
 static u_int64_t			tracker_error;
 static u_int64_t			tracker_unknown;
+static int					cfg_updates = 0;
 /*--------------------------------------------------------------------------*/
 static int conntrack_callback(enum nf_conntrack_msg_type type,struct nf_conntrack *ct,void *data)
 {
@@ -60,36 +72,81 @@ info.orig_proto = nfct_get_attr_u8(ct,ATTR_ORIG_L4PROTO);
 // ignore everything except TCP and UDP
 if ((info.orig_proto != IPPROTO_TCP) && (info.orig_proto != IPPROTO_UDP)) return(NFCT_CB_CONTINUE);
 
-// get the source and destination addresses
-info.orig_saddr = nfct_get_attr_u32(ct,ATTR_ORIG_IPV4_SRC);
-info.orig_daddr = nfct_get_attr_u32(ct,ATTR_ORIG_IPV4_DST);
+// get the address family
+info.orig_family = nfct_get_attr_u8(ct,ATTR_L3PROTO);
+memset(info.orig_saddr,0,sizeof(info.orig_saddr));
+memset(info.orig_daddr,0,sizeof(info.orig_daddr));
+memset(info.repl_saddr,0,sizeof(info.repl_saddr));
+memset(info.repl_daddr,0,sizeof(info.repl_daddr));
 
-// ignore anything on the loopback interface by looking at the least
-// significant byte because these values are in network byte order
-if ((info.orig_saddr & 0x000000FF) == 0x0000007F) return(NFCT_CB_CONTINUE);
-if ((info.orig_daddr & 0x000000FF) == 0x0000007F) return(NFCT_CB_CONTINUE);
+	// get the source and destination addresses which are in network byte
+	// order and ignore anything on the loopback interface, and leave the
+	// reply addresses zero for an event that has no reply tuple
+	switch(info.orig_family)
+	{
+	case AF_INET:
+		memcpy(info.orig_saddr,nfct_get_attr(ct,ATTR_ORIG_IPV4_SRC),4);
+		memcpy(info.orig_daddr,nfct_get_attr(ct,ATTR_ORIG_IPV4_DST),4);
+		if (info.orig_saddr[0] == 127) return(NFCT_CB_CONTINUE);
+		if (info.orig_daddr[0] == 127) return(NFCT_CB_CONTINUE);
+		if (nfct_attr_is_set(ct,ATTR_REPL_IPV4_SRC) > 0) memcpy(info.repl_saddr,nfct_get_attr(ct,ATTR_REPL_IPV4_SRC),4);
+		if (nfct_attr_is_set(ct,ATTR_REPL_IPV4_DST) > 0) memcpy(info.repl_daddr,nfct_get_attr(ct,ATTR_REPL_IPV4_DST),4);
+		break;
+	case AF_INET6:
+		memcpy(info.orig_saddr,nfct_get_attr(ct,ATTR_ORIG_IPV6_SRC),16);
+		memcpy(info.orig_daddr,nfct_get_attr(ct,ATTR_ORIG_IPV6_DST),16);
+		if (IN6_IS_ADDR_LOOPBACK((struct in6_addr *)info.orig_saddr)) return(NFCT_CB_CONTINUE);
+		if (IN6_IS_ADDR_LOOPBACK((struct in6_addr *)info.orig_daddr)) return(NFCT_CB_CONTINUE);
+		if (nfct_attr_is_set(ct,ATTR_REPL_IPV6_SRC) > 0) memcpy(info.repl_saddr,nfct_get_attr(ct,ATTR_REPL_IPV6_SRC),16);
+		if (nfct_attr_is_set(ct,ATTR_REPL_IPV6_DST) > 0) memcpy(info.repl_daddr,nfct_get_attr(ct,ATTR_REPL_IPV6_DST),16);
+		break;
+	default:
+		return(NFCT_CB_CONTINUE);
+	}
 
 // get all of the source and destination ports
 info.orig_sport = be16toh(nfct_get_attr_u16(ct,ATTR_ORIG_PORT_SRC));
 info.orig_dport = be16toh(nfct_get_attr_u16(ct,ATTR_ORIG_PORT_DST));
+info.repl_sport = be16toh(nfct_get_attr_u16(ct,ATTR_REPL_PORT_SRC));
+info.repl_dport = be16toh(nfct_get_attr_u16(ct,ATTR_REPL_PORT_DST));
 
-// get the byte counts
+// get the packet and byte counts which are only sent with some events
+info.has_counters = (nfct_attr_is_set(ct,ATTR_ORIG_COUNTER_BYTES) > 0);
+info.orig_packets = nfct_get_attr_u64(ct,ATTR_ORIG_COUNTER_PACKETS);
 info.orig_bytes = nfct_get_attr_u64(ct,ATTR_ORIG_COUNTER_BYTES);
+info.repl_packets = nfct_get_attr_u64(ct,ATTR_REPL_COUNTER_PACKETS);
 info.repl_bytes = nfct_get_attr_u64(ct,ATTR_REPL_COUNTER_BYTES);
 
+// get the mark, zone, status, and timeout along with the TCP state
+info.mark = nfct_get_attr_u32(ct,ATTR_MARK);
+info.zone = nfct_get_attr_u16(ct,ATTR_ZONE);
+info.status = nfct_get_attr_u32(ct,ATTR_STATUS);
+info.timeout = nfct_get_attr_u32(ct,ATTR_TIMEOUT);
+info.tcp_state = 0;
+if (info.orig_proto == IPPROTO_TCP) info.tcp_state = nfct_get_attr_u8(ct,ATTR_TCP_STATE);
+
 go_conntrack_callback(&info);
 
 return(NFCT_CB_CONTINUE);
 }
 /*--------------------------------------------------------------------------*/
+static void conntrack_configure(int updates)
+{
+cfg_updates = updates;
+logmessage(LOG_INFO,"Conntrack updates %d\n",cfg_updates);
+}
+/*--------------------------------------------------------------------------*/
 static int conntrack_startup(void)
 {
-int		ret;
+unsigned	groups;
+int			ret;
 
 // Open a netlink conntrack handle. The header file defines
-// NFCT_ALL_CT_GROUPS but we really only care about new and
-// destroy so we subscribe to just those ignoring update
-nfcth = nfct_open(CONNTRACK,NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_DESTROY);
+// NFCT_ALL_CT_GROUPS but update events are frequent so we only
+// subscribe to them when they were requested
+groups = (NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_DESTROY);
+if (cfg_updates != 0) groups |= NF_NETLINK_CONNTRACK_UPDATE;
+nfcth = nfct_open(CONNTRACK,groups);
 
 	if (nfcth == NULL)
 	{
@@ -141,8 +198,6 @@ ret = conntrack_startup();
 	return(1);
 	}
 
-go_child_startup();
-
 	// the nfct_catch function should only return if it receives a signal
 	// other than EINTR or if NFCT_CB_STOP is returned from the callback
 	while (g_shutdown == 0)
@@ -154,7 +209,6 @@ go_child_startup();
 conntrack_shutdown();
 
 logmessage(LOG_INFO,"The conntrack thread has terminated\n");
-go_child_goodbye();
 return(0);
 }
 /*--------------------------------------------------------------------------*/
@@ -166,7 +220,7 @@ g_shutdown = 1;
 if (nfcth == NULL) return;
 
 // dump the conntrack table to interrupt the nfct_catch function
-family = AF_INET;
+family = AF_UNSPEC;
 nfct_send(nfcth,NFCT_Q_DUMP,&family);
 }
 /*--------------------------------------------------------------------------*/
@@ -177,8 +231,64 @@ int			ret;
 
 if (nfcth == NULL) return;
 
-family = AF_INET;
+// use AF_UNSPEC to dump both the IPv4 and IPv6 entries
+family = AF_UNSPEC;
 ret = nfct_send(nfcth,NFCT_Q_DUMP,&family);
 logmessage(LOG_INFO,"nfct_send() result = %d\n",ret);
 }
 /*--------------------------------------------------------------------------*/
+static struct nf_conntrack *conntrack_object(u_int8_t family,u_int8_t proto,const u_int8_t *saddr,const u_int8_t *daddr,u_int16_t sport,u_int16_t dport)
+{
+struct nf_conntrack	*ct;
+
+ct = nfct_new();
+if (ct == NULL) return(NULL);
+
+// the addresses are in network byte order and the ports are not
+nfct_set_attr_u8(ct,ATTR_L3PROTO,family);
+nfct_set_attr_u8(ct,ATTR_L4PROTO,proto);
+
+	if (family == AF_INET)
+	{
+	nfct_set_attr(ct,ATTR_ORIG_IPV4_SRC,saddr);
+	nfct_set_attr(ct,ATTR_ORIG_IPV4_DST,daddr);
+	}
+	else
+	{
+	nfct_set_attr(ct,ATTR_ORIG_IPV6_SRC,saddr);
+	nfct_set_attr(ct,ATTR_ORIG_IPV6_DST,daddr);
+	}
+
+nfct_set_attr_u16(ct,ATTR_ORIG_PORT_SRC,htobe16(sport));
+nfct_set_attr_u16(ct,ATTR_ORIG_PORT_DST,htobe16(dport));
+
+return(ct);
+}
+/*--------------------------------------------------------------------------*/
+static int conntrack_destroy(u_int8_t family,u_int8_t proto,const u_int8_t *saddr,const u_int8_t *daddr,u_int16_t sport,u_int16_t dport)
+{
+struct nfct_handle	*handle;
+struct nf_conntrack	*ct;
+int					ret;
+
+ct = conntrack_object(family,proto,saddr,daddr,sport,dport);
+if (ct == NULL) return(ENOMEM);
+
+// the event handle is busy in nfct_catch so we use a new one
+handle = nfct_open(CONNTRACK,0);
+
+	if (handle == NULL)
+	{
+	ret = errno;
+	nfct_destroy(ct);
+	return(ret);
+	}
+
+ret = 0;
+if (nfct_query(handle,NFCT_Q_DESTROY,ct) != 0) ret = errno;
+
+nfct_close(handle);
+nfct_destroy(ct);
+return(ret);
+}
+/*--------------------------------------------------------------------------*/
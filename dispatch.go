@@ -0,0 +1,220 @@
+package main
+
+import "sync"
+import "time"
+import "sync/atomic"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Plugin netfilter handlers are called by a fixed pool of worker goroutines
+ * instead of a new goroutine for every plugin for every packet. The state
+ * for each packet is kept in a dispatchPacket that is reused from a pool.
+ * A packet holds one reference for netfilterHandler and one for each
+ * queued handler, and goes back to the pool when the last one is released,
+ * so a handler that misses the deadline never sees its packet reused.
+ *
+ * The packet buffer is only lent to the handlers until the verdict. The
+ * state for each handler is moved from queued to running by the worker
+ * and from queued to cancelled when the verdict is issued, so a handler
+ * that has not started by then is never called and never sees the buffer.
+ * Only a handler that was already running when it missed the deadline can
+ * still be using the buffer, and bufferRetained gives the receive loop a
+ * new one so the old buffer is never written while that call is running.
+ */
+type dispatchPacket struct {
+	ctx     support.PacketContext
+	buffer  *bufferHolder
+	pipe    chan handlerResult
+	results []support.Verdict
+	waiting []bool
+	state   []int32
+	timer   *time.Timer
+	refs    int32
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The handlerResult is used to pass the verdict from each plugin handler
+ * back to netfilterHandler.
+ */
+type handlerResult struct {
+	index   int
+	verdict support.Verdict
+}
+
+/*---------------------------------------------------------------------------*/
+type dispatchJob struct {
+	packet  *dispatchPacket
+	handler support.NetfilterHandle
+	index   int
+}
+
+// the states for each handler of a dispatchPacket
+const (
+	handlerQueued int32 = iota
+	handlerRunning
+	handlerCancelled
+)
+
+/*
+ * The handlerTimeout is the longest we wait for a plugin netfilter handler.
+ * The default verdict is used for any handler that misses the deadline.
+ */
+var handlerTimeout time.Duration
+var dispatchQueue chan dispatchJob
+var packetPool = sync.Pool{New: newDispatchPacket}
+
+/*---------------------------------------------------------------------------*/
+func dispatchStartup(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	dispatchQueue = make(chan dispatchJob, workers*4)
+
+	for i := 0; i < workers; i++ {
+		go dispatchWorker()
+	}
+
+	support.LogMessage("Started %d netfilter dispatch workers\n", workers)
+}
+
+/*---------------------------------------------------------------------------*/
+func dispatchWorker() {
+	for job := range dispatchQueue {
+		if atomic.CompareAndSwapInt32(&job.packet.state[job.index], handlerQueued, handlerRunning) {
+			verdict := support.RunNetfilterHandler(job.handler, &job.packet.ctx)
+			job.packet.pipe <- handlerResult{index: job.index, verdict: verdict}
+		} else {
+			support.IncrementCounter("plugin." + job.handler.Name() + ".skipped")
+		}
+		job.packet.release()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func newDispatchPacket() interface{} {
+	packet := new(dispatchPacket)
+	packet.pipe = make(chan handlerResult, 16)
+	packet.timer = time.NewTimer(time.Hour)
+	packet.timer.Stop()
+	return (packet)
+}
+
+/*---------------------------------------------------------------------------*/
+func acquirePacket(queue int, count int) *dispatchPacket {
+	packet := packetPool.Get().(*dispatchPacket)
+	packet.refs = 1
+
+	// keep the receive buffer until every handler is done with the packet
+	packet.buffer = currentBuffer[queue]
+	packet.buffer.retain()
+
+	// the pipe must be large enough that handlers never block sending
+	if cap(packet.pipe) < count {
+		packet.pipe = make(chan handlerResult, count)
+	}
+
+	if cap(packet.results) < count {
+		packet.results = make([]support.Verdict, count)
+		packet.waiting = make([]bool, count)
+		packet.state = make([]int32, count)
+	}
+
+	packet.results = packet.results[:count]
+	packet.waiting = packet.waiting[:count]
+	packet.state = packet.state[:count]
+	return (packet)
+}
+
+/*---------------------------------------------------------------------------*/
+func (packet *dispatchPacket) release() {
+	if atomic.AddInt32(&packet.refs, -1) != 0 {
+		return
+	}
+
+	// discard any results that arrived after the deadline
+	for len(packet.pipe) > 0 {
+		<-packet.pipe
+	}
+
+	packet.buffer.release()
+	packet.buffer = nil
+	packet.ctx = support.PacketContext{}
+	for i := range packet.results {
+		packet.results[i] = support.Verdict{}
+		packet.waiting[i] = false
+		packet.state[i] = handlerQueued
+	}
+
+	packetPool.Put(packet)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * dispatchHandlers queues the netfilter handler for every plugin subscribed
+ * to the session and waits for the results or the deadline. Handlers that
+ * do not finish in time, or that can not be queued because every worker is
+ * busy, get the default verdict, and those that have not started are
+ * cancelled so they are never called.
+ */
+func dispatchHandlers(packet *dispatchPacket, handlers []support.NetfilterHandle) {
+	count := 0
+
+	for i, handler := range handlers {
+		if !packet.ctx.Session.IsSubscribed(handler.Name()) {
+			continue
+		}
+
+		atomic.AddInt32(&packet.refs, 1)
+
+		select {
+		case dispatchQueue <- dispatchJob{packet: packet, handler: handler, index: i}:
+			packet.waiting[i] = true
+			count++
+		default:
+			atomic.AddInt32(&packet.refs, -1)
+			support.IncrementCounter("dispatch.overflow")
+			packet.results[i] = support.GetDefaultVerdict()
+		}
+	}
+
+	if count == 0 {
+		return
+	}
+
+	packet.timer.Reset(handlerTimeout)
+
+	for count > 0 {
+		select {
+		case result := <-packet.pipe:
+			packet.results[result.index] = result.verdict
+			packet.waiting[result.index] = false
+			count--
+		case <-packet.timer.C:
+			for i, handler := range handlers {
+				if !packet.waiting[i] {
+					continue
+				}
+				atomic.CompareAndSwapInt32(&packet.state[i], handlerQueued, handlerCancelled)
+				support.LogMessage("Plugin %s netfilter handler timeout\n", handler.Name())
+				support.IncrementCounter("plugin." + handler.Name() + ".timeout")
+				packet.results[i] = support.GetDefaultVerdict()
+			}
+			count = 0
+		}
+	}
+
+	if !packet.timer.Stop() {
+		select {
+		case <-packet.timer.C:
+		default:
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,225 @@
+package main
+
+import "net"
+import "sync"
+import "time"
+import "testing"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The tests in this package share one plugin, since plugins can not be
+ * unregistered, and change what it does with setHandler. The handler is
+ * reset to a plain accept when the test is done.
+ */
+type testPlugin struct {
+	handler  func(ctx *support.PacketContext) support.Verdict
+	streamer func(stream *support.StreamData)
+	logged   chan support.Logger
+	mutex    sync.Mutex
+}
+
+var testNetfilter = &testPlugin{logged: make(chan support.Logger, 16)}
+var testOnce sync.Once
+var testChildsync sync.WaitGroup
+
+/*---------------------------------------------------------------------------*/
+func (p *testPlugin) Name() string {
+	return ("test")
+}
+
+func (p *testPlugin) Startup(childsync *sync.WaitGroup) {
+}
+
+func (p *testPlugin) Goodbye(childsync *sync.WaitGroup) {
+}
+
+func (p *testPlugin) NetfilterHandler(ctx *support.PacketContext) support.Verdict {
+	p.mutex.Lock()
+	handler := p.handler
+	p.mutex.Unlock()
+
+	if handler == nil {
+		return (support.Verdict{Action: support.VerdictAccept})
+	}
+	return (handler(ctx))
+}
+
+func (p *testPlugin) NetloggerHandler(logger *support.Logger) {
+	select {
+	case p.logged <- *logger:
+	default:
+	}
+}
+
+func (p *testPlugin) StreamHandler(stream *support.StreamData) {
+	p.mutex.Lock()
+	streamer := p.streamer
+	p.mutex.Unlock()
+
+	if streamer != nil {
+		streamer(stream)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func setHandler(t testing.TB, handler func(ctx *support.PacketContext) support.Verdict) {
+	testNetfilter.mutex.Lock()
+	testNetfilter.handler = handler
+	testNetfilter.mutex.Unlock()
+
+	t.Cleanup(func() {
+		testNetfilter.mutex.Lock()
+		testNetfilter.handler = nil
+		testNetfilter.mutex.Unlock()
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+func setStreamHandler(t testing.TB, streamer func(stream *support.StreamData)) {
+	testNetfilter.mutex.Lock()
+	testNetfilter.streamer = streamer
+	testNetfilter.mutex.Unlock()
+
+	t.Cleanup(func() {
+		testNetfilter.mutex.Lock()
+		testNetfilter.streamer = nil
+		testNetfilter.mutex.Unlock()
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * testStartup does the same startup as main with one queue and no backend.
+ */
+func testStartup() {
+	testOnce.Do(func() {
+		support.Startup()
+		support.SetQueueConfig(support.QueueConfig{QueueFirst: 2000, QueueCount: 1})
+		support.RegisterPlugin(testNetfilter)
+		support.StartPlugins(&testChildsync)
+		handlerTimeout = 100 * time.Millisecond
+		dispatchStartup(2)
+		streamStartup(1)
+		bufferStartup(1)
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * testPacket returns a UDP packet starting with the IPv4 header.
+ */
+func testPacket(t testing.TB, client string, cport uint16, server string, sport uint16) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP(client).To4(), DstIP: net.ParseIP(server).To4()}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(cport), DstPort: layers.UDPPort(sport)}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload([]byte("packetd test payload")))
+	if err != nil {
+		t.Fatalf("unable to build the test packet: %s", err)
+	}
+	return (buffer.Bytes())
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * benchPacket returns a context for a decoded packet with a session that
+ * is subscribed to the test plugin, and a list that calls the test plugin
+ * as if there were several netfilter plugins.
+ */
+func benchPacket(b *testing.B) (support.PacketContext, []support.NetfilterHandle) {
+	var ctx support.PacketContext
+
+	testStartup()
+	buffer := testPacket(b, "10.1.0.1", 40000, "10.1.0.2", 53)
+	handlers := support.GetNetfilterPlugins()
+	if len(handlers) != 1 {
+		b.Fatalf("there are %d netfilter plugins", len(handlers))
+	}
+
+	ctx.Buffer = buffer
+	ctx.Length = len(buffer)
+	ctx.Packet = gopacket.NewPacket(buffer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ctx.Tuple = support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("10.1.0.1").To4(), ClientPort: 40000, ServerAddr: net.ParseIP("10.1.0.2").To4(), ServerPort: 53}
+	ctx.Session, _ = support.FindOrCreateSession(ctx.Tuple)
+	ctx.ClientToServer = true
+
+	return ctx, []support.NetfilterHandle{handlers[0], handlers[0], handlers[0], handlers[0]}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * BenchmarkDispatchPool measures dispatchHandlers with the worker pool and
+ * the pooled packet state, which should not allocate.
+ */
+func BenchmarkDispatchPool(b *testing.B) {
+	template, handlers := benchPacket(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		packet := acquirePacket(0, len(handlers))
+		packet.ctx = template
+		dispatchHandlers(packet, handlers)
+		packet.release()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * BenchmarkDispatchGoroutines measures the dispatch we had before the worker
+ * pool, with a new context, results, channel, timer, and goroutine for each
+ * plugin for every packet, as the baseline for BenchmarkDispatchPool.
+ */
+func BenchmarkDispatchGoroutines(b *testing.B) {
+	template, handlers := benchPacket(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ctx := new(support.PacketContext)
+		*ctx = template
+
+		results := make([]support.Verdict, len(handlers))
+		waiting := make([]bool, len(handlers))
+		pipe := make(chan handlerResult, len(handlers))
+		count := 0
+		for i, handler := range handlers {
+			if !ctx.Session.IsSubscribed(handler.Name()) {
+				continue
+			}
+			waiting[i] = true
+			count++
+			go func(i int, handler support.NetfilterHandle) {
+				pipe <- handlerResult{index: i, verdict: support.RunNetfilterHandler(handler, ctx)}
+			}(i, handler)
+		}
+
+		deadline := time.NewTimer(handlerTimeout)
+		for count > 0 {
+			select {
+			case result := <-pipe:
+				results[result.index] = result.verdict
+				waiting[result.index] = false
+				count--
+			case <-deadline.C:
+				count = 0
+			}
+		}
+		deadline.Stop()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -4,57 +4,83 @@ import "fmt"
 import "sync"
 import "encoding/hex"
 import "github.com/untangle/packetd/support"
-import "github.com/google/gopacket"
-import "github.com/google/gopacket/layers"
+
+var markField support.MarkField
+
+/*---------------------------------------------------------------------------*/
+type Plugin struct {
+}
+
+/*---------------------------------------------------------------------------*/
+func (p *Plugin) Name() string {
+	return ("example")
+}
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Startup(childsync *sync.WaitGroup) {
+func (p *Plugin) Startup(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Startup(%s) has been called\n", "example")
+
+	var err error
+	markField, err = support.AllocateMark(p.Name(), "example", 16, 1)
+	if err != nil {
+		support.LogMessage("Unable to allocate mark field: %s\n", err)
+	}
+
 	childsync.Add(1)
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Goodbye(childsync *sync.WaitGroup) {
+func (p *Plugin) Goodbye(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Goodbye(%s) has been called\n", "example")
+	support.FreeMarks(p.Name())
 	childsync.Done()
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_netfilter_handler(ch chan<- int32, buffer []byte, length int) {
-	packet := gopacket.NewPacket(buffer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer != nil {
-		addr := ipLayer.(*layers.IPv4)
-		fmt.Printf("NETFILTER %d BYTES FROM %s\n%s\n", length, addr.SrcIP, hex.Dump(buffer))
+func (p *Plugin) NetfilterHandler(ctx *support.PacketContext) support.Verdict {
+	source := ctx.Tuple.ClientAddr
+	if !ctx.ClientToServer {
+		source = ctx.Tuple.ServerAddr
 	}
+	fmt.Printf("NETFILTER %d BYTES FROM %s SESSION %d\n%s\n", ctx.Length, source, ctx.Session.SessionId, hex.Dump(ctx.Buffer))
 
-	// use the channel to return our mark bits
-	ch <- 1
+	// ask for the reassembled data for TCP sessions
+	if ctx.TCPLayer != nil {
+		ctx.Session.SubscribeStream(p.Name())
+	}
+
+	// accept the packet and return our mark bits and since we only need
+	// to see the first packet we release the session
+	return (support.Verdict{Action: support.VerdictAccept, Mark: markField.Value(1), Mask: markField.Mask, Release: true})
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_conntrack_handler(message int, entry *support.ConntrackEntry) {
-	fmt.Printf("CONNTRACK MSG:%c PROTO:%d SADDR:%s SPORT:%d DADDR:%s DPORT:%d TX:%d RX:%d UC:%d\n",
+func (p *Plugin) ConntrackHandler(message int, entry *support.ConntrackEntry) {
+	fmt.Printf("CONNTRACK MSG:%c PROTO:%d SADDR:%s SPORT:%d DADDR:%s DPORT:%d RADDR:%s RPORT:%d TX:%d RX:%d MARK:%X STATE:%d UC:%d\n",
 		message,
 		entry.SessionTuple.Protocol,
 		entry.SessionTuple.ClientAddr,
 		entry.SessionTuple.ClientPort,
 		entry.SessionTuple.ServerAddr,
 		entry.SessionTuple.ServerPort,
+		entry.ReplyTuple.ClientAddr,
+		entry.ReplyTuple.ClientPort,
 		entry.C2Sbytes,
 		entry.S2Cbytes,
+		entry.ConnMark,
+		entry.TCPState,
 		entry.UpdateCount)
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_netlogger_handler(logger *support.Logger) {
+func (p *Plugin) NetloggerHandler(logger *support.Logger) {
 	fmt.Printf("NETLOGGER PROTO:%d ICMP:%d SIF:%d DIF:%d SADR:%s DADR:%s SPORT:%d DPORT:%d MARK:%X PREFIX:%s\n",
 		logger.Protocol,
 		logger.IcmpType,
 		logger.SrcIntf,
 		logger.DstIntf,
-		support.Int2Ip(logger.SrcAddr),
-		support.Int2Ip(logger.DstAddr),
+		logger.SrcAddr,
+		logger.DstAddr,
 		logger.SrcPort,
 		logger.DstPort,
 		logger.Mark,
@@ -62,3 +88,22 @@ func Plugin_netlogger_handler(logger *support.Logger) {
 }
 
 /*---------------------------------------------------------------------------*/
+func (p *Plugin) StreamHandler(stream *support.StreamData) {
+	if stream.Closed {
+		fmt.Printf("STREAM SESSION %d C2S:%v CLOSED\n", stream.Session.SessionId, stream.ClientToServer)
+		return
+	}
+
+	data := stream.Data
+	if len(data) > 64 {
+		data = data[:64]
+	}
+	fmt.Printf("STREAM SESSION %d C2S:%v SKIPPED:%v %d BYTES\n%s\n", stream.Session.SessionId, stream.ClientToServer, stream.Skipped, len(stream.Data), hex.Dump(data))
+
+	// we only want to see the start of the server response
+	if !stream.ClientToServer {
+		stream.Session.ReleaseStream(p.Name())
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -3,16 +3,33 @@ package geoip
 import "sync"
 import "github.com/untangle/packetd/support"
 import "github.com/oschwald/geoip2-golang"
-import "github.com/google/gopacket"
-import "github.com/google/gopacket/layers"
+
+const defaultDatabase = "/var/cache/untangle-geoip/GeoLite2-City.mmdb"
 
 var geodb *geoip2.Reader
+var databaseFile = defaultDatabase
+var markField support.MarkField
+
+/*---------------------------------------------------------------------------*/
+type Plugin struct {
+}
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Startup(childsync *sync.WaitGroup) {
+func (p *Plugin) Name() string {
+	return ("geoip")
+}
+
+/*---------------------------------------------------------------------------*/
+func (p *Plugin) Startup(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Startup(%s) has been called\n", "geoip")
 
-	db, err := geoip2.Open("/var/cache/untangle-geoip/GeoLite2-City.mmdb")
+	var err error
+	markField, err = support.AllocateMark(p.Name(), "geoip", 18, 1)
+	if err != nil {
+		support.LogMessage("Unable to allocate mark field: %s\n", err)
+	}
+
+	db, err := geoip2.Open(databaseFile)
 	if err != nil {
 		support.LogMessage("Unable to load GeoIP Database: %s\n", err)
 	} else {
@@ -23,36 +40,60 @@ func Plugin_Startup(childsync *sync.WaitGroup) {
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_Goodbye(childsync *sync.WaitGroup) {
+func (p *Plugin) Goodbye(childsync *sync.WaitGroup) {
 	support.LogMessage("Plugin_Goodbye(%s) has been called\n", "geoip")
-	geodb.Close()
+	support.FreeMarks(p.Name())
+	if geodb != nil {
+		geodb.Close()
+		geodb = nil
+	}
 	childsync.Done()
 }
 
 /*---------------------------------------------------------------------------*/
-func Plugin_netfilter_handler(ch chan<- int32, buffer []byte, length int) {
-	support.LogMessage("GEOIP RECEIVED %d BYTES\n", length)
-	packet := gopacket.NewPacket(buffer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer != nil {
-		addr := ipLayer.(*layers.IPv4)
+
+/*
+ * The database setting selects the GeoIP database file and is used the
+ * next time the plugin is started.
+ */
+func (p *Plugin) Configure(settings map[string]interface{}) {
+	if value, ok := settings["database"].(string); ok {
+		databaseFile = value
+	} else {
+		databaseFile = defaultDatabase
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func (p *Plugin) NetfilterHandler(ctx *support.PacketContext) support.Verdict {
+	support.LogMessage("GEOIP RECEIVED %d BYTES\n", ctx.Length)
+
+	// without the database there is nothing we can do for the session
+	if geodb == nil {
+		return (support.Verdict{Action: support.VerdictAccept, Release: true})
+	}
+
+	// we only need to do the lookups once for each session
+	if client, _ := ctx.Session.GetLocations(); client == "" {
 		var SrcCode string = "XX"
 		var DstCode string = "XX"
-		SrcRecord, err := geodb.City(addr.SrcIP)
+		SrcRecord, err := geodb.City(ctx.Tuple.ClientAddr)
 		if err == nil {
 			SrcCode = SrcRecord.Country.IsoCode
 		}
-		DstRecord, err := geodb.City(addr.DstIP)
+		DstRecord, err := geodb.City(ctx.Tuple.ServerAddr)
 		if err == nil {
 			DstCode = DstRecord.Country.IsoCode
 		}
-		support.LogMessage("SRC: %s = %s\n", addr.SrcIP, SrcCode)
-		support.LogMessage("DST: %s = %s\n", addr.DstIP, DstCode)
-	}
+		support.LogMessage("SRC: %s = %s\n", ctx.Tuple.ClientAddr, SrcCode)
+		support.LogMessage("DST: %s = %s\n", ctx.Tuple.ServerAddr, DstCode)
 
-	// TODO - store the country values in the session object
+		// the tuple is always in the client to server direction
+		ctx.Session.SetLocations(SrcCode, DstCode)
+	}
 
-	ch <- 4
+	// the locations are stored in the session so we can release it
+	return (support.Verdict{Action: support.VerdictAccept, Mark: markField.Value(1), Mask: markField.Mask, Release: true})
 }
 
 /*---------------------------------------------------------------------------*/
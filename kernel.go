@@ -0,0 +1,268 @@
+package main
+
+import "fmt"
+import "net"
+import "sort"
+import "sync/atomic"
+import "encoding/binary"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The packets, conntrack events, and log events all come from the kernel
+ * through one of these sources. A backend provides all three, and the one
+ * used is picked at startup with the -backend flag. The cgo backend uses
+ * the libnetfilter libraries, the netlink backend talks to the kernel
+ * directly in Go, and the fake backend is fed by test code. Every backend
+ * passes what it receives to queuePacket, conntrackHandler, and
+ * netloggerHandler so the rest of the daemon does not know which is used.
+ * The conntrack source also implements support.ConntrackControl.
+ */
+type queueSource interface {
+	Configure(config support.QueueConfig) error
+	Run(index int) error
+	Shutdown()
+}
+
+type conntrackSource interface {
+	Configure(updates bool) error
+	Run() error
+	Dump()
+	Destroy(tuple support.Tuple) error
+	Update(tuple support.Tuple, update support.ConntrackUpdate) error
+	Shutdown()
+}
+
+type loggerSource interface {
+	Run() error
+	Shutdown()
+}
+
+type kernelBackend struct {
+	queue     queueSource
+	conntrack conntrackSource
+	logger    loggerSource
+}
+
+/*
+ * conntrackInfo is what the conntrack sources pass to conntrackHandler. The
+ * message is N for new, U for update, or D for destroy, the tuple is in the
+ * original direction, and the reply tuple is in the reply direction after
+ * NAT. Anything a source does not know is left as zero. The kernel only
+ * sends the counters with destroy events and dump results, so the counters
+ * flag is set when the packet and byte counts are real.
+ */
+type conntrackInfo struct {
+	message     int
+	tuple       support.Tuple
+	replyTuple  support.Tuple
+	origPackets uint64
+	origBytes   uint64
+	replPackets uint64
+	replBytes   uint64
+	counters    bool
+	mark        uint32
+	zone        uint16
+	status      uint32
+	tcpState    uint8
+	timeout     uint32
+}
+
+// the backend used when none is given with the -backend flag
+var defaultBackend = "netlink"
+
+var backendTable = make(map[string]func() kernelBackend)
+
+/*
+ * The shutdown flag is set when we are stopping or a source has failed.
+ * The sources check it between receives and the main loop checks it to
+ * know when a source has failed.
+ */
+var shutdownFlag int32
+
+/*---------------------------------------------------------------------------*/
+func registerBackend(name string, create func() kernelBackend) {
+	backendTable[name] = create
+}
+
+/*---------------------------------------------------------------------------*/
+func createBackend(name string) (kernelBackend, error) {
+	create, ok := backendTable[name]
+	if !ok {
+		return kernelBackend{}, fmt.Errorf("invalid backend %s (available: %v)", name, backendNames())
+	}
+	return create(), nil
+}
+
+/*---------------------------------------------------------------------------*/
+func backendNames() []string {
+	var list []string
+	for name := range backendTable {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+func setShutdownFlag() {
+	atomic.StoreInt32(&shutdownFlag, 1)
+}
+
+/*---------------------------------------------------------------------------*/
+func getShutdownFlag() bool {
+	return (atomic.LoadInt32(&shutdownFlag) != 0)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * runSource runs a source function in a new goroutine that is tracked by
+ * childsync. A source only returns on its own if something went wrong, in
+ * which case we set the shutdown flag so everything else stops too.
+ */
+func runSource(name string, run func() error) {
+	childsync.Add(1)
+
+	go func() {
+		defer childsync.Done()
+
+		err := run()
+		if getShutdownFlag() {
+			return
+		}
+
+		if err != nil {
+			support.LogMessage("The %s source failed: %s\n", name, err)
+		} else {
+			support.LogMessage("The %s source stopped unexpectedly\n", name)
+		}
+		setShutdownFlag()
+	}()
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * queuePacket is called by the queue sources for every packet. The verdict
+ * only has a rewritten packet when it is valid for the action, and the
+ * reject is sent here so the source only needs to drop the packet.
+ */
+func queuePacket(index int, mark uint32, buffer []byte) support.Verdict {
+	verdict, decoded := netfilterHandler(index, mark, buffer)
+
+	if verdict.Packet != nil {
+		if (verdict.Action != support.VerdictAccept) && (verdict.Action != support.VerdictRepeat) {
+			verdict.Packet = nil
+		} else if len(verdict.Packet) > 0xFFFF {
+			support.IncrementCounter("netfilter.rewrite_invalid")
+			verdict.Packet = nil
+		} else {
+			support.IncrementCounter("netfilter.rewrite")
+		}
+	}
+
+	if (verdict.Action == support.VerdictReject) && (decoded != nil) {
+		sendReject(decoded)
+	}
+
+	return (verdict)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Called by the queue sources when the kernel dropped messages because the
+ * socket receive buffer was full.
+ */
+func queueOverrun(index int) {
+	support.IncrementCounter("netfilter.enobufs")
+	overloadEnter(fmt.Sprintf("receive buffer overrun on queue %d", support.GetQueueConfig().QueueFirst+index))
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * netloggerPacket fills in a logger from a packet sent to the log group.
+ * The mark holds the source interface in the low byte and the destination
+ * interface in the next byte.
+ */
+func netloggerPacket(mark uint32, prefix string, packet []byte) {
+	var logger support.Logger
+	var offset int
+
+	if len(packet) < 20 {
+		return
+	}
+
+	logger.Mark = mark
+	logger.Prefix = prefix
+	logger.SrcIntf = uint8(mark & 0xFF)
+	logger.DstIntf = uint8((mark & 0xFF00) >> 8)
+
+	switch packet[0] >> 4 {
+	case 4:
+		logger.Protocol = packet[9]
+		logger.SrcAddr = net.IP(append([]byte(nil), packet[12:16]...))
+		logger.DstAddr = net.IP(append([]byte(nil), packet[16:20]...))
+		offset = int(packet[0]&0x0F) << 2
+	case 6:
+		if len(packet) < 40 {
+			return
+		}
+		logger.Protocol = packet[6]
+		logger.SrcAddr = net.IP(append([]byte(nil), packet[8:24]...))
+		logger.DstAddr = net.IP(append([]byte(nil), packet[24:40]...))
+		offset = 40
+	default:
+		return
+	}
+
+	// Since 0 is a valid ICMP type we use 999 to signal null or unknown
+	logger.IcmpType = 999
+	header := []byte{}
+	if offset < len(packet) {
+		header = packet[offset:]
+	}
+
+	switch logger.Protocol {
+	case 1, 58:
+		if len(header) >= 1 {
+			logger.IcmpType = uint16(header[0])
+		}
+	case 6, 17:
+		if len(header) >= 4 {
+			logger.SrcPort = binary.BigEndian.Uint16(header[0:])
+			logger.DstPort = binary.BigEndian.Uint16(header[2:])
+		}
+	}
+
+	netloggerHandler(&logger)
+}
+
+/*---------------------------------------------------------------------------*/
+func netloggerHandler(logger *support.Logger) {
+	// call the netlogger handler for every plugin that has one
+	for _, handler := range support.GetNetloggerPlugins() {
+		go support.RunNetloggerHandler(handler, logger)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * conntrackWanted returns true for the conntrack events passed to
+ * conntrackHandler, which are TCP and UDP not on the loopback interface.
+ */
+func conntrackWanted(protocol uint8, src net.IP, dst net.IP) bool {
+	if (protocol != 6) && (protocol != 17) {
+		return false
+	}
+	if (src == nil) || (dst == nil) || src.IsLoopback() || dst.IsLoopback() {
+		return false
+	}
+	return true
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,275 @@
+//go:build !nolibnetfilter
+// +build !nolibnetfilter
+
+package main
+
+//#include "common.h"
+//#include "netfilter.h"
+//#include "conntrack.h"
+//#include "netlogger.h"
+//#cgo CFLAGS: -D_GNU_SOURCE
+//#cgo LDFLAGS: -lnetfilter_queue -lnfnetlink -lnetfilter_conntrack -lnetfilter_log
+import "C"
+
+import "fmt"
+import "net"
+import "unsafe"
+import "syscall"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The cgo backend uses the libnetfilter libraries through the C code in the
+ * header files. The C threads have their own shutdown flag so we set it when
+ * we are stopping, and they return when it is set by an error. All of the C
+ * code must stay in this file since the headers define static variables. It
+ * is the default when the libraries are available and can be left out of
+ * the build with the nolibnetfilter tag.
+ */
+type cgoQueue struct {
+}
+
+type cgoConntrack struct {
+}
+
+type cgoLogger struct {
+}
+
+/*---------------------------------------------------------------------------*/
+func init() {
+	defaultBackend = "cgo"
+	registerBackend("cgo", func() kernelBackend {
+		C.common_startup()
+		return kernelBackend{queue: &cgoQueue{}, conntrack: &cgoConntrack{}, logger: &cgoLogger{}}
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *cgoQueue) Configure(config support.QueueConfig) error {
+	C.netfilter_configure(C.int(config.QueueFirst), C.int(config.QueueCount), C.int(config.SockBuffer), C.int(config.QueueMaxlen), C.int(config.NetBuffer))
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *cgoQueue) Run(index int) error {
+	if C.netfilter_thread(C.int(index)) != 0 {
+		return fmt.Errorf("the netfilter thread for queue index %d failed to start", index)
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *cgoQueue) Shutdown() {
+	C.netfilter_goodbye()
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *cgoConntrack) Configure(updates bool) error {
+	var value C.int
+
+	if updates {
+		value = 1
+	}
+	C.conntrack_configure(value)
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *cgoConntrack) Run() error {
+	if C.conntrack_thread() != 0 {
+		return fmt.Errorf("the conntrack thread failed to start")
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *cgoConntrack) Dump() {
+	C.conntrack_dump()
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *cgoConntrack) Destroy(tuple support.Tuple) error {
+	family, saddr, daddr := makeAddressPair(tuple)
+
+	ret := C.conntrack_destroy(family, C.u_int8_t(tuple.Protocol), (*C.u_int8_t)(unsafe.Pointer(&saddr[0])), (*C.u_int8_t)(unsafe.Pointer(&daddr[0])), C.u_int16_t(tuple.ClientPort), C.u_int16_t(tuple.ServerPort))
+	if ret != 0 {
+		return syscall.Errno(ret)
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Update goes through the nfnetlink package instead of the C code. A change
+ * to the connmark has to be sent with CTA_MARK_MASK so the kernel changes
+ * only the bits owned by the plugin in one step, but NFCT_Q_UPDATE only
+ * sends the full mark, so with libnetfilter_conntrack we would have to read
+ * the entry and write back the merged mark. That loses any bit set by the
+ * CONNMARK rules in between, such as the bypass bit. The nfnetlink package
+ * is plain Go with its own socket for each request, so using it here adds
+ * no library and does not touch the conntrack handle of the C thread.
+ */
+func (ct *cgoConntrack) Update(tuple support.Tuple, update support.ConntrackUpdate) error {
+	return updateConntrack(tuple, update)
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *cgoConntrack) Shutdown() {
+	C.conntrack_goodbye()
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *cgoLogger) Run() error {
+	C.netlogger_thread()
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *cgoLogger) Shutdown() {
+	C.netlogger_goodbye()
+}
+
+/*---------------------------------------------------------------------------*/
+//export go_netfilter_callback
+func go_netfilter_callback(index C.int, mark C.uint, data *C.uchar, size C.int, nmark *C.uint, ndata **C.uchar, nlen *C.int) C.int {
+
+	// ***** this version creates a Go copy of the buffer = SLOWER
+	// buffer := C.GoBytes(unsafe.Pointer(data),size)
+
+	// ***** this version creates a Go pointer to the buffer = FASTER
+	buffer := (*[0xFFFF]byte)(unsafe.Pointer(data))[:int(size):int(size)]
+
+	verdict := queuePacket(int(index), uint32(mark), buffer)
+
+	// return the updated mark to be set on the packet
+	*nmark = C.uint(verdict.Mark)
+
+	// return the rewritten packet in memory that netq_callback will free
+	if verdict.Packet != nil {
+		*ndata = (*C.uchar)(C.CBytes(verdict.Packet))
+		*nlen = C.int(len(verdict.Packet))
+	}
+
+	switch verdict.Action {
+	case support.VerdictDrop, support.VerdictReject:
+		return (C.NF_DROP)
+	case support.VerdictRepeat:
+		return (C.NF_REPEAT)
+	}
+
+	return (C.NF_ACCEPT)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Called by netfilter_thread after each buffer has been processed. We
+ * return one if the buffer now belongs to the go side, which will free it
+ * when the last handler is done, so netfilter_thread will allocate a new one.
+ */
+//export go_netfilter_retained
+func go_netfilter_retained(index C.int, buffer unsafe.Pointer) C.int {
+	// the free function must be set before we drop our reference
+	currentBuffer[index].free = func() { C.free(buffer) }
+
+	if bufferRetained(int(index)) {
+		return (1)
+	}
+	return (0)
+}
+
+/*---------------------------------------------------------------------------*/
+//export go_netfilter_overload
+func go_netfilter_overload(index C.int) {
+	queueOverrun(int(index))
+}
+
+/*---------------------------------------------------------------------------*/
+//export go_conntrack_callback
+func go_conntrack_callback(info *C.struct_conntrack_info) {
+	var event conntrackInfo
+
+	event.message = int(info.msg_type)
+
+	event.tuple.Protocol = uint8(info.orig_proto)
+	event.tuple.ClientAddr = makeAddress(info.orig_family, &info.orig_saddr[0])
+	event.tuple.ClientPort = uint16(info.orig_sport)
+	event.tuple.ServerAddr = makeAddress(info.orig_family, &info.orig_daddr[0])
+	event.tuple.ServerPort = uint16(info.orig_dport)
+
+	event.replyTuple.Protocol = uint8(info.orig_proto)
+	event.replyTuple.ClientAddr = makeAddress(info.orig_family, &info.repl_saddr[0])
+	event.replyTuple.ClientPort = uint16(info.repl_sport)
+	event.replyTuple.ServerAddr = makeAddress(info.orig_family, &info.repl_daddr[0])
+	event.replyTuple.ServerPort = uint16(info.repl_dport)
+
+	event.origPackets = uint64(info.orig_packets)
+	event.origBytes = uint64(info.orig_bytes)
+	event.replPackets = uint64(info.repl_packets)
+	event.replBytes = uint64(info.repl_bytes)
+	event.counters = (info.has_counters != 0)
+	event.mark = uint32(info.mark)
+	event.zone = uint16(info.zone)
+	event.status = uint32(info.status)
+	event.tcpState = uint8(info.tcp_state)
+	event.timeout = uint32(info.timeout)
+
+	conntrackHandler(&event)
+}
+
+/*---------------------------------------------------------------------------*/
+//export go_netlogger_callback
+func go_netlogger_callback(info *C.struct_netlogger_info) {
+	var logger support.Logger
+
+	logger.Protocol = uint8(info.protocol)
+	logger.IcmpType = uint16(info.icmp_type)
+	logger.SrcIntf = uint8(info.src_intf)
+	logger.DstIntf = uint8(info.dst_intf)
+	logger.SrcAddr = makeAddress(info.family, &info.src_addr[0])
+	logger.DstAddr = makeAddress(info.family, &info.dst_addr[0])
+	logger.SrcPort = uint16(info.src_port)
+	logger.DstPort = uint16(info.dst_port)
+	logger.Mark = uint32(info.mark)
+	logger.Prefix = C.GoString(info.prefix)
+
+	netloggerHandler(&logger)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The C structures hold addresses in network byte order in a 16 byte array
+ * with IPv4 addresses in the first 4 bytes, so we copy the bytes used by
+ * the address family into a net.IP of the matching length.
+ */
+func makeAddress(family C.u_int8_t, addr *C.u_int8_t) net.IP {
+	if family == C.AF_INET6 {
+		return (net.IP(C.GoBytes(unsafe.Pointer(addr), net.IPv6len)))
+	}
+	return (net.IP(C.GoBytes(unsafe.Pointer(addr), net.IPv4len)))
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * makeAddressPair returns the address family and the client and server
+ * addresses of a tuple in the 16 byte arrays used by the C structures.
+ */
+func makeAddressPair(tuple support.Tuple) (C.u_int8_t, [16]byte, [16]byte) {
+	var saddr, daddr [16]byte
+
+	if (tuple.ClientAddr.To4() != nil) && (tuple.ServerAddr.To4() != nil) {
+		copy(saddr[:], tuple.ClientAddr.To4())
+		copy(daddr[:], tuple.ServerAddr.To4())
+		return C.AF_INET, saddr, daddr
+	}
+
+	copy(saddr[:], tuple.ClientAddr.To16())
+	copy(daddr[:], tuple.ServerAddr.To16())
+	return C.AF_INET6, saddr, daddr
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,244 @@
+package main
+
+import "sync"
+import "syscall"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The fake backend does no kernel I/O. Packets and events are passed in by
+ * calling the Inject functions, which makes it possible to test the packet
+ * path and the plugins without netfilter privileges. The packets for each
+ * queue are handled by the Run goroutine for the queue just like the real
+ * backends, and Inject waits for and returns the verdict. Anything injected
+ * after the backend is shut down is ignored. Like a real receive buffer,
+ * the packet is copied into a buffer for the queue that is reused for the
+ * next packet unless a plugin handler is still using it.
+ */
+type fakePacket struct {
+	mark  uint32
+	data  []byte
+	reply chan support.Verdict
+}
+
+type fakeQueue struct {
+	packets []chan fakePacket
+	buffers [][]byte
+	done    chan bool
+}
+
+type fakeConntrack struct {
+	events  chan conntrackInfo
+	dumps   chan bool
+	done    chan bool
+	changes map[string]support.ConntrackUpdate
+	mutex   sync.Mutex
+}
+
+type fakeLogger struct {
+	events chan support.Logger
+	done   chan bool
+}
+
+/*---------------------------------------------------------------------------*/
+func init() {
+	registerBackend("fake", func() kernelBackend {
+		return newFakeBackend()
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+func newFakeBackend() kernelBackend {
+	queue := &fakeQueue{done: make(chan bool)}
+	conntrack := &fakeConntrack{events: make(chan conntrackInfo), dumps: make(chan bool, 1), done: make(chan bool), changes: make(map[string]support.ConntrackUpdate)}
+	logger := &fakeLogger{events: make(chan support.Logger), done: make(chan bool)}
+	return kernelBackend{queue: queue, conntrack: conntrack, logger: logger}
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *fakeQueue) Configure(config support.QueueConfig) error {
+	queue.packets = make([]chan fakePacket, config.QueueCount)
+	queue.buffers = make([][]byte, config.QueueCount)
+	for i := range queue.packets {
+		queue.packets[i] = make(chan fakePacket)
+		queue.buffers[i] = make([]byte, 0xFFFF)
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *fakeQueue) Run(index int) error {
+	for {
+		select {
+		case packet := <-queue.packets[index]:
+			size := copy(queue.buffers[index], packet.data)
+			packet.reply <- queuePacket(index, packet.mark, queue.buffers[index][:size])
+			if bufferRetained(index) {
+				queue.buffers[index] = make([]byte, 0xFFFF)
+			}
+		case <-queue.done:
+			return nil
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *fakeQueue) Shutdown() {
+	close(queue.done)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Inject passes a packet starting with the IP header to the queue and
+ * returns the verdict.
+ */
+func (queue *fakeQueue) Inject(index int, mark uint32, data []byte) support.Verdict {
+	packet := fakePacket{mark: mark, data: data, reply: make(chan support.Verdict, 1)}
+
+	select {
+	case queue.packets[index] <- packet:
+		return <-packet.reply
+	case <-queue.done:
+		return support.GetDefaultVerdict()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *fakeConntrack) Configure(updates bool) error {
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *fakeConntrack) Run() error {
+	for {
+		select {
+		case event := <-ct.events:
+			conntrackHandler(&event)
+		case <-ct.done:
+			return nil
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Dump does nothing since there is no table, but the request is recorded so
+ * the caller can use Dumped to see that it happened.
+ */
+func (ct *fakeConntrack) Dump() {
+	select {
+	case ct.dumps <- true:
+	default:
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *fakeConntrack) Dumped() bool {
+	select {
+	case <-ct.dumps:
+		return true
+	default:
+		return false
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Destroy acts like the kernel by sending a destroy event for the entry in
+ * the conntrack table that matches the tuple in either direction.
+ */
+func (ct *fakeConntrack) Destroy(tuple support.Tuple) error {
+	for _, finder := range []support.Tuple{tuple, support.ReverseTuple(tuple)} {
+		if entry, ok := support.FindConntrackEntry(support.Tuple2String(finder)); ok {
+			ct.Inject(conntrackInfo{message: 'D', tuple: entry.SessionTuple, replyTuple: entry.ReplyTuple})
+			return nil
+		}
+	}
+	return syscall.ENOENT
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Update merges the changes for the entry in the conntrack table that
+ * matches the tuple in either direction with any earlier ones so the caller
+ * can use Updated to see the result.
+ */
+func (ct *fakeConntrack) Update(tuple support.Tuple, update support.ConntrackUpdate) error {
+	for _, finder := range []support.Tuple{tuple, support.ReverseTuple(tuple)} {
+		entry, ok := support.FindConntrackEntry(support.Tuple2String(finder))
+		if !ok {
+			continue
+		}
+
+		key := support.Tuple2String(entry.SessionTuple)
+
+		ct.mutex.Lock()
+		current := ct.changes[key]
+		current.SetMark(update.Mark, update.MarkMask)
+		for i := range update.LabelMask {
+			current.Labels[i] = (current.Labels[i] &^ update.LabelMask[i]) | (update.Labels[i] & update.LabelMask[i])
+			current.LabelMask[i] |= update.LabelMask[i]
+		}
+		ct.changes[key] = current
+		ct.mutex.Unlock()
+		return nil
+	}
+	return syscall.ENOENT
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *fakeConntrack) Updated(tuple support.Tuple) (support.ConntrackUpdate, bool) {
+	ct.mutex.Lock()
+	update, ok := ct.changes[support.Tuple2String(tuple)]
+	ct.mutex.Unlock()
+	return update, ok
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *fakeConntrack) Shutdown() {
+	close(ct.done)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Inject passes a conntrack event to conntrackHandler.
+ */
+func (ct *fakeConntrack) Inject(info conntrackInfo) {
+	select {
+	case ct.events <- info:
+	case <-ct.done:
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *fakeLogger) Run() error {
+	for {
+		select {
+		case event := <-logger.events:
+			netloggerHandler(&event)
+		case <-logger.done:
+			return nil
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *fakeLogger) Shutdown() {
+	close(logger.done)
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *fakeLogger) Inject(event support.Logger) {
+	select {
+	case logger.events <- event:
+	case <-logger.done:
+	}
+}
+
+/*---------------------------------------------------------------------------*/
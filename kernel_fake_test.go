@@ -0,0 +1,304 @@
+package main
+
+import "net"
+import "time"
+import "testing"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * testBackend starts the fake backend the same way as main and shuts it
+ * down when the test is done.
+ */
+func testBackend(t *testing.T) (*fakeQueue, *fakeConntrack, *fakeLogger) {
+	testStartup()
+	kernel := newFakeBackend()
+
+	kernel.queue.Configure(support.GetQueueConfig())
+	bufferStartup(support.GetQueueConfig().QueueCount)
+	kernel.conntrack.Configure(true)
+	support.SetConntrackControl(kernel.conntrack)
+
+	done := make(chan bool, 3)
+	go func() { kernel.queue.Run(0); done <- true }()
+	go func() { kernel.conntrack.Run(); done <- true }()
+	go func() { kernel.logger.Run(); done <- true }()
+
+	t.Cleanup(func() {
+		kernel.queue.Shutdown()
+		kernel.conntrack.Shutdown()
+		kernel.logger.Shutdown()
+		<-done
+		<-done
+		<-done
+	})
+
+	return kernel.queue.(*fakeQueue), kernel.conntrack.(*fakeConntrack), kernel.logger.(*fakeLogger)
+}
+
+/*---------------------------------------------------------------------------*/
+func waitFor(t *testing.T, what string, check func() bool) {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+/*---------------------------------------------------------------------------*/
+func TestFakeQueuePacket(t *testing.T) {
+	queue, _, _ := testBackend(t)
+
+	setHandler(t, func(ctx *support.PacketContext) support.Verdict {
+		if ctx.Tuple.ClientPort == 43002 {
+			return (support.Verdict{Action: support.VerdictDrop, Packet: []byte{0x45}})
+		}
+		return (support.Verdict{Action: support.VerdictAccept})
+	})
+
+	verdict := queue.Inject(0, 0x0101, testPacket(t, "10.4.0.1", 43001, "10.4.0.2", 53))
+	if (verdict.Action != support.VerdictAccept) || (verdict.Mark != 0x0101) {
+		t.Errorf("the verdict is %+v", verdict)
+	}
+
+	tuple := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("10.4.0.1").To4(), ClientPort: 43001, ServerAddr: net.ParseIP("10.4.0.2").To4(), ServerPort: 53}
+	if _, ok := support.FindSessionTuple(tuple); !ok {
+		t.Errorf("the packet did not create a session")
+	}
+
+	// a rewritten packet is only passed back with an accept or repeat
+	verdict = queue.Inject(0, 0, testPacket(t, "10.4.0.1", 43002, "10.4.0.2", 53))
+	if (verdict.Action != support.VerdictDrop) || (verdict.Packet != nil) {
+		t.Errorf("the verdict is %+v", verdict)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestFakeConntrackEvents(t *testing.T) {
+	_, ct, _ := testBackend(t)
+	tuple := support.Tuple{Protocol: 6, ClientAddr: net.ParseIP("10.5.0.1").To4(), ClientPort: 44001, ServerAddr: net.ParseIP("10.5.0.2").To4(), ServerPort: 80}
+	finder := support.Tuple2String(tuple)
+
+	ct.Inject(conntrackInfo{message: 'N', tuple: tuple, replyTuple: support.ReverseTuple(tuple), mark: 0x0202})
+
+	var entry support.ConntrackEntry
+	waitFor(t, "the conntrack entry", func() bool {
+		var ok bool
+		entry, ok = support.FindConntrackEntry(finder)
+		return ok
+	})
+
+	session, ok := support.FindSessionTuple(tuple)
+	if !ok || (session.SessionId != entry.SessionId) || (entry.ConnMark != 0x0202) {
+		t.Fatalf("the entry %+v does not match the session", entry)
+	}
+
+	// plugins change the connmark through the conntrack source
+	if _, err := support.AllocateMark("test", "conntrack", 16, 4); err != nil {
+		t.Fatalf("unable to allocate the mark: %s", err)
+	}
+	defer support.FreeMarks("test")
+
+	if err := support.SetConnmark("test", support.ReverseTuple(tuple), 0x50000, 0xF0000); err != nil {
+		t.Fatalf("SetConnmark failed: %s", err)
+	}
+	if update, ok := ct.Updated(tuple); !ok || (update.Mark != 0x50000) || (update.MarkMask != 0xF0000) {
+		t.Errorf("the conntrack update is %+v", update)
+	}
+	if support.SetConnmark("test", tuple, 0x1, 0x1) == nil {
+		t.Errorf("SetConnmark changed bits outside the owned fields")
+	}
+
+	ct.Dump()
+	if !ct.Dumped() {
+		t.Errorf("the dump was not requested")
+	}
+
+	// a failed kill leaves the session alone
+	other := support.Tuple{Protocol: 6, ClientAddr: net.ParseIP("10.5.0.3").To4(), ClientPort: 44002, ServerAddr: net.ParseIP("10.5.0.2").To4(), ServerPort: 80}
+	support.FindOrCreateSession(other)
+	if support.KillTuple(other, 0) == nil {
+		t.Errorf("KillTuple worked without a conntrack entry")
+	}
+	if _, ok = support.FindSessionTuple(other); !ok {
+		t.Errorf("a failed kill removed the session")
+	}
+
+	// killing the session destroys the conntrack entry which ends the session
+	if err := support.KillTuple(tuple, 0); err != nil {
+		t.Fatalf("KillTuple failed: %s", err)
+	}
+
+	waitFor(t, "the destroy event", func() bool {
+		entry, _ = support.FindConntrackEntry(finder)
+		_, ok = support.FindSessionTuple(tuple)
+		return entry.PurgeFlag && !ok
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Only destroy events and dump results have counters, so the zero counts
+ * in the other events must not look like a reused tuple.
+ */
+func TestConntrackEventsWithoutCounters(t *testing.T) {
+	_, ct, _ := testBackend(t)
+	tuple := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("10.6.0.1").To4(), ClientPort: 45001, ServerAddr: net.ParseIP("10.6.0.2").To4(), ServerPort: 53}
+	finder := support.Tuple2String(tuple)
+	reused := support.GetCounters()["conntrack.reused"]
+
+	ct.Inject(conntrackInfo{message: 'U', tuple: tuple, counters: true, origPackets: 4, origBytes: 5000, replPackets: 2, replBytes: 800})
+	ct.Inject(conntrackInfo{message: 'U', tuple: tuple})
+
+	var entry support.ConntrackEntry
+	waitFor(t, "the conntrack update", func() bool {
+		entry, _ = support.FindConntrackEntry(finder)
+		return entry.UpdateCount == 2
+	})
+
+	if support.GetCounters()["conntrack.reused"] != reused {
+		t.Errorf("an event without counters replaced the entry")
+	}
+	if (entry.C2Sbytes != 5000) || (entry.S2Cbytes != 800) {
+		t.Errorf("the byte counts are %d and %d", entry.C2Sbytes, entry.S2Cbytes)
+	}
+	if (entry.C2Spackets != 4) || (entry.S2Cpackets != 2) {
+		t.Errorf("the packet counts are %d and %d", entry.C2Spackets, entry.S2Cpackets)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The packets for a port forward reach the queue after DNAT, so conntrack
+ * must find their session with the reply tuple.
+ */
+func TestConntrackPortForward(t *testing.T) {
+	queue, ct, _ := testBackend(t)
+	tuple := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("10.7.0.1").To4(), ClientPort: 46001, ServerAddr: net.ParseIP("203.0.113.1").To4(), ServerPort: 5353}
+	reply := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("192.168.7.5").To4(), ClientPort: 53, ServerAddr: net.ParseIP("10.7.0.1").To4(), ServerPort: 46001}
+
+	queue.Inject(0, 0, testPacket(t, "10.7.0.1", 46001, "192.168.7.5", 53))
+	session, ok := support.FindSessionTuple(support.ReverseTuple(reply))
+	if !ok {
+		t.Fatalf("the packet did not create a session")
+	}
+
+	ct.Inject(conntrackInfo{message: 'N', tuple: tuple, replyTuple: reply})
+
+	var entry support.ConntrackEntry
+	waitFor(t, "the conntrack entry", func() bool {
+		entry, ok = support.FindConntrackEntry(support.Tuple2String(tuple))
+		return ok
+	})
+	if entry.SessionId != session.SessionId {
+		t.Errorf("conntrack has session %d instead of %d", entry.SessionId, session.SessionId)
+	}
+
+	ct.Inject(conntrackInfo{message: 'D', tuple: tuple, replyTuple: reply})
+	waitFor(t, "the session to be removed", func() bool {
+		_, found := support.FindSessionTuple(support.ReverseTuple(reply))
+		return !found
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Conntrack does not know a port forward by the tuple of its packets, so
+ * killing the session by id must use the tuple from the conntrack entry.
+ */
+func TestKillPortForwardSession(t *testing.T) {
+	queue, _, _ := testBackend(t)
+	tuple := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("10.9.0.1").To4(), ClientPort: 48001, ServerAddr: net.ParseIP("203.0.113.9").To4(), ServerPort: 5353}
+	reply := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("192.168.9.5").To4(), ClientPort: 53, ServerAddr: net.ParseIP("10.9.0.1").To4(), ServerPort: 48001}
+	finder := support.Tuple2String(tuple)
+
+	queue.Inject(0, 0, testPacket(t, "10.9.0.1", 48001, "192.168.9.5", 53))
+	session, ok := support.FindSessionTuple(support.ReverseTuple(reply))
+	if !ok {
+		t.Fatalf("the packet did not create a session")
+	}
+
+	// the conntrack entry for the session has the tuples from before DNAT
+	support.InsertConntrackEntry(finder, support.ConntrackEntry{SessionId: session.SessionId, SessionTuple: tuple, ReplyTuple: reply})
+
+	if err := support.KillSession(session.SessionId, time.Minute); err != nil {
+		t.Fatalf("KillSession failed: %s", err)
+	}
+
+	waitFor(t, "the destroy event", func() bool {
+		entry, _ := support.FindConntrackEntry(finder)
+		return entry.PurgeFlag
+	})
+
+	// the packets in flight are blocked with the tuple they carry
+	verdict := queue.Inject(0, 0, testPacket(t, "10.9.0.1", 48001, "192.168.9.5", 53))
+	if verdict.Action != support.VerdictDrop {
+		t.Errorf("a packet for the killed session got %+v", verdict)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * When a tuple is reused the old conntrack entry is replaced, and only the
+ * old session is removed, not the one the packets just created for the new
+ * flow.
+ */
+func TestConntrackReusedTuple(t *testing.T) {
+	queue, ct, _ := testBackend(t)
+	tuple := support.Tuple{Protocol: 17, ClientAddr: net.ParseIP("10.8.0.1").To4(), ClientPort: 47001, ServerAddr: net.ParseIP("10.8.0.2").To4(), ServerPort: 53}
+	finder := support.Tuple2String(tuple)
+
+	ct.Inject(conntrackInfo{message: 'N', tuple: tuple})
+	ct.Inject(conntrackInfo{message: 'D', tuple: tuple})
+
+	var entry support.ConntrackEntry
+	waitFor(t, "the destroy event", func() bool {
+		entry, _ = support.FindConntrackEntry(finder)
+		return entry.PurgeFlag
+	})
+	old := entry.SessionId
+
+	queue.Inject(0, 0, testPacket(t, "10.8.0.1", 47001, "10.8.0.2", 53))
+	session, ok := support.FindSessionTuple(tuple)
+	if !ok || (session.SessionId == old) {
+		t.Fatalf("the packet did not create a new session")
+	}
+
+	ct.Inject(conntrackInfo{message: 'N', tuple: tuple})
+	waitFor(t, "the new conntrack entry", func() bool {
+		entry, _ = support.FindConntrackEntry(finder)
+		return !entry.PurgeFlag
+	})
+
+	if entry.SessionId != session.SessionId {
+		t.Errorf("conntrack has session %d instead of %d", entry.SessionId, session.SessionId)
+	}
+	if _, ok = support.FindSessionTuple(tuple); !ok {
+		t.Errorf("the session for the new flow was removed")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestFakeLogger(t *testing.T) {
+	_, _, logger := testBackend(t)
+
+	logger.Inject(support.Logger{Protocol: 6, SrcIntf: 1, DstIntf: 2, Prefix: "test"})
+
+	select {
+	case event := <-testNetfilter.logged:
+		if (event.Prefix != "test") || (event.SrcIntf != 1) || (event.DstIntf != 2) {
+			t.Errorf("the logger event is %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the netlogger handler was not called")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,348 @@
+package main
+
+import "sync"
+import "runtime"
+import "syscall"
+import "unsafe"
+import "github.com/untangle/packetd/support"
+import "github.com/untangle/packetd/nfnetlink"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The netlink backend talks to the kernel with the nfnetlink package so it
+ * does not need cgo or the libnetfilter libraries. Each queue is handled
+ * by a goroutine locked to an OS thread that runs on the CPU that feeds the
+ * queue, just like the netfilter_thread in the cgo backend.
+ */
+type netlinkQueue struct {
+	config support.QueueConfig
+}
+
+type netlinkConntrack struct {
+	handle  *nfnetlink.Conntrack
+	mutex   sync.Mutex
+	updates bool
+}
+
+type netlinkLogger struct {
+}
+
+// the log group and settings used by the netlogger
+const netloggerGroup = 0
+const netloggerCopyRange = 256
+const netloggerBufferSize = 0x8000
+
+/*---------------------------------------------------------------------------*/
+func init() {
+	registerBackend("netlink", func() kernelBackend {
+		return kernelBackend{queue: &netlinkQueue{}, conntrack: &netlinkConntrack{}, logger: &netlinkLogger{}}
+	})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * On older kernels unbinding a protocol family removes it for every handle
+ * so we do it once here rather than when each queue is opened where it
+ * would break the queues that were already started.
+ */
+func (queue *netlinkQueue) Configure(config support.QueueConfig) error {
+	queue.config = config
+
+	support.LogMessage("Netfilter queue %d count %d sock_buffer %d maxlen %d buffer %d\n", config.QueueFirst, config.QueueCount, config.SockBuffer, config.QueueMaxlen, config.NetBuffer)
+
+	if err := nfnetlink.UnbindQueueFamilies(); err != nil {
+		support.LogMessage("Error unbinding the netfilter queue families: %s\n", err)
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *netlinkQueue) Run(index int) error {
+	number := queue.config.QueueFirst + index
+
+	support.LogMessage("The netfilter thread for queue %d is starting\n", number)
+
+	// run on the CPU that feeds our queue
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	setAffinity(index % runtime.NumCPU())
+
+	handle, err := nfnetlink.OpenQueue(uint16(number), uint32(queue.config.NetBuffer), uint32(queue.config.QueueMaxlen))
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	// accept packets instead of dropping them when the queue is full but
+	// keep going on older kernels that do not support the flag
+	if err = handle.SetFailOpen(); err != nil {
+		support.LogMessage("Error setting fail open on queue %d: %s\n", number, err)
+	}
+
+	if queue.config.SockBuffer != 0 {
+		if err = handle.SetReceiveBuffer(queue.config.SockBuffer); err != nil {
+			return err
+		}
+	}
+
+	// the buffer must hold the largest packet along with the message headers
+	size := queue.config.NetBuffer + 4096
+	buffer := make([]byte, size)
+
+	for !getShutdownFlag() {
+		list, err := handle.Receive(buffer)
+
+		// the kernel could not deliver packets because our socket
+		// buffer was full so tell the overload monitor we are behind
+		if err == syscall.ENOBUFS {
+			queueOverrun(index)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			continue
+		}
+
+		for _, packet := range list {
+			verdict := queuePacket(index, packet.Mark, packet.Payload)
+
+			action := uint32(nfnetlink.VerdictAccept)
+			switch verdict.Action {
+			case support.VerdictDrop, support.VerdictReject:
+				action = nfnetlink.VerdictDrop
+			case support.VerdictRepeat:
+				action = nfnetlink.VerdictRepeat
+			}
+
+			if err = handle.Verdict(packet.Id, action, verdict.Mark, verdict.Packet); err != nil {
+				support.LogMessage("Error setting the verdict on queue %d: %s\n", number, err)
+			}
+		}
+
+		// if plugin handlers are still using the buffer we need a new one
+		if bufferRetained(index) {
+			buffer = make([]byte, size)
+		}
+	}
+
+	support.LogMessage("The netfilter thread for queue %d has terminated\n", number)
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *netlinkQueue) Shutdown() {
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * setAffinity limits the current thread to a single CPU. The runtime has
+ * no call for this so we use the system call directly.
+ */
+func setAffinity(cpu int) {
+	var mask [16]uint64
+
+	if cpu >= len(mask)*64 {
+		return
+	}
+
+	mask[cpu/64] = (1 << uint(cpu%64))
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		support.LogMessage("Error %s returned from sched_setaffinity(%d)\n", errno, cpu)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+func (ct *netlinkConntrack) Configure(updates bool) error {
+	ct.updates = updates
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * We subscribe to new and destroy events and also to update events if they
+ * were requested. The mutex protects the handle since the main loop can
+ * call Dump at any time.
+ */
+func (ct *netlinkConntrack) Run() error {
+	buffer := make([]byte, 0x10000)
+
+	support.LogMessage("The conntrack thread is starting\n")
+
+	groups := []int{nfnetlink.GroupConntrackNew, nfnetlink.GroupConntrackDestroy}
+	if ct.updates {
+		groups = append(groups, nfnetlink.GroupConntrackUpdate)
+	}
+
+	handle, err := nfnetlink.OpenConntrack(groups...)
+	if err != nil {
+		return err
+	}
+
+	ct.mutex.Lock()
+	ct.handle = handle
+	ct.mutex.Unlock()
+
+	defer func() {
+		ct.mutex.Lock()
+		ct.handle.Close()
+		ct.handle = nil
+		ct.mutex.Unlock()
+	}()
+
+	for !getShutdownFlag() {
+		list, err := handle.Receive(buffer)
+
+		// we missed some events but the periodic dump will catch up
+		if err == syscall.ENOBUFS {
+			support.IncrementCounter("conntrack.enobufs")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, event := range list {
+			if !conntrackWanted(event.Orig.Protocol, event.Orig.SrcAddr, event.Orig.DstAddr) {
+				continue
+			}
+
+			var info conntrackInfo
+			info.message = event.Type
+			info.tuple = makeConntrackTuple(event.Orig)
+			info.replyTuple = makeConntrackTuple(event.Reply)
+			info.origPackets = event.OrigPackets
+			info.origBytes = event.OrigBytes
+			info.replPackets = event.ReplPackets
+			info.replBytes = event.ReplBytes
+			info.counters = event.HasCounters
+			info.mark = event.Mark
+			info.zone = event.Zone
+			info.status = event.Status
+			info.tcpState = event.TCPState
+			info.timeout = event.Timeout
+
+			conntrackHandler(&info)
+		}
+	}
+
+	support.LogMessage("The conntrack thread has terminated\n")
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *netlinkConntrack) Dump() {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	if ct.handle == nil {
+		return
+	}
+
+	// the dump includes both the IPv4 and IPv6 entries
+	if err := ct.handle.Dump(); err != nil {
+		support.LogMessage("Error requesting the conntrack dump: %s\n", err)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Destroy and Update use their own socket since the event handle is busy
+ * receiving, and the kernel finds the entry with the tuple in either
+ * direction.
+ */
+func (ct *netlinkConntrack) Destroy(tuple support.Tuple) error {
+	return nfnetlink.DestroyConntrack(makeNetlinkTuple(tuple))
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *netlinkConntrack) Update(tuple support.Tuple, update support.ConntrackUpdate) error {
+	return updateConntrack(tuple, update)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * updateConntrack is also used by the cgo backend since libnetfilter_conntrack
+ * does not send the mark mask, and changing the mark without it would race
+ * with the CONNMARK rules that set the bypass bit.
+ */
+func updateConntrack(tuple support.Tuple, update support.ConntrackUpdate) error {
+	var change nfnetlink.ConntrackChange
+	change.Mark = update.Mark
+	change.MarkMask = update.MarkMask
+	change.Labels = update.Labels
+	change.LabelMask = update.LabelMask
+	return nfnetlink.UpdateConntrack(makeNetlinkTuple(tuple), change)
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *netlinkConntrack) Shutdown() {
+}
+
+/*---------------------------------------------------------------------------*/
+func makeConntrackTuple(value nfnetlink.ConntrackTuple) support.Tuple {
+	var tuple support.Tuple
+	tuple.Protocol = value.Protocol
+	tuple.ClientAddr = value.SrcAddr
+	tuple.ClientPort = value.SrcPort
+	tuple.ServerAddr = value.DstAddr
+	tuple.ServerPort = value.DstPort
+	return (tuple)
+}
+
+/*---------------------------------------------------------------------------*/
+func makeNetlinkTuple(tuple support.Tuple) nfnetlink.ConntrackTuple {
+	var value nfnetlink.ConntrackTuple
+	value.Protocol = tuple.Protocol
+	value.SrcAddr = tuple.ClientAddr
+	value.SrcPort = tuple.ClientPort
+	value.DstAddr = tuple.ServerAddr
+	value.DstPort = tuple.ServerPort
+	return (value)
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *netlinkLogger) Run() error {
+	buffer := make([]byte, netloggerBufferSize)
+
+	support.LogMessage("The netlogger thread is starting\n")
+
+	handle, err := nfnetlink.OpenLog(netloggerGroup, netloggerCopyRange, netloggerBufferSize)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	for !getShutdownFlag() {
+		list, err := handle.Receive(buffer)
+		if err == syscall.ENOBUFS {
+			support.IncrementCounter("netlogger.enobufs")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, packet := range list {
+			netloggerPacket(packet.Mark, packet.Prefix, packet.Payload)
+		}
+	}
+
+	support.LogMessage("The netlogger thread has terminated\n")
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (logger *netlinkLogger) Shutdown() {
+}
+
+/*---------------------------------------------------------------------------*/
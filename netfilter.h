@@ -8,24 +8,38 @@
  */
 
 /*--------------------------------------------------------------------------*/
-extern int go_netfilter_callback(int mark,unsigned char* data, int len);
-extern void go_child_startup(void);
-extern void go_child_goodbye(void);
+// must match support.MaxQueueCount
+#define NETFILTER_MAX_QUEUES 64
 /*--------------------------------------------------------------------------*/
-static struct nfq_q_handle		*nfqqh;
-static struct nfq_handle		*nfqh;
+struct netfilter_queue
+{
+	struct nfq_handle		*nfqh;
+	struct nfq_q_handle		*nfqqh;
+	int						index;
+	int						number;
+};
+/*--------------------------------------------------------------------------*/
+extern int go_netfilter_callback(int index,unsigned int mark,unsigned char* data,int len,unsigned int* nmark,unsigned char** ndata,int* nlen);
+extern int go_netfilter_retained(int index,void* buffer);
+extern void go_netfilter_overload(int index);
+/*--------------------------------------------------------------------------*/
+static struct netfilter_queue	queue_list[NETFILTER_MAX_QUEUES];
 static int						cfg_sock_buffer = 1048576;
 static int						cfg_net_maxlen = 10240;
 static int						cfg_net_buffer = 32768;
 static int						cfg_net_queue = 1818;
+static int						cfg_net_count = 1;
 /*--------------------------------------------------------------------------*/
 static int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data *nfad,void *data)
 {
+struct netfilter_queue			*queue = (struct netfilter_queue *)data;
 struct nfqnl_msg_packet_hdr		*hdr;
 unsigned char					*rawpkt;
+unsigned char					*newpkt;
 struct iphdr					*iphead;
-int								rawlen;
-int								omark,nmark;
+int								rawlen,newlen;
+unsigned int					omark,nmark;
+int								verdict;
 
 // get the packet header and mark
 hdr = nfq_get_msg_packet_hdr(nfad);
@@ -45,67 +59,122 @@ rawlen = nfq_get_payload(nfad,(unsigned char **)&rawpkt);
 // use the iphdr structure for parsing
 iphead = (struct iphdr *)rawpkt;
 
-// ignore everything except IPv4
-if (iphead->version != 4) return(0);
+	// for IPv4 we only care about TCP and UDP
+	if ((iphead->version == 4) && (iphead->protocol != IPPROTO_TCP) && (iphead->protocol != IPPROTO_UDP))
+	{
+	nfq_set_verdict(qh,(hdr ? ntohl(hdr->packet_id) : 0),NF_ACCEPT,0,NULL);
+	return(0);
+	}
 
-// we only care about TCP and UDP
-if ((iphead->protocol != IPPROTO_TCP) && (iphead->protocol != IPPROTO_UDP)) return(0);
+	// IPv6 packets can have extension headers before the TCP or UDP header
+	// so we pass them all along and the go handler finds the protocol
+	if ((iphead->version == 6) && (rawlen < (int)sizeof(struct ip6_hdr)))
+	{
+	nfq_set_verdict(qh,(hdr ? ntohl(hdr->packet_id) : 0),NF_ACCEPT,0,NULL);
+	logmessage(LOG_WARNING,"Invalid IPv6 length %d received\n",rawlen);
+	return(0);
+	}
 
-// call the go handler function
-nmark = go_netfilter_callback(omark,rawpkt,rawlen);
+	// ignore everything except IPv4 and IPv6
+	if ((iphead->version != 4) && (iphead->version != 6))
+	{
+	nfq_set_verdict(qh,(hdr ? ntohl(hdr->packet_id) : 0),NF_ACCEPT,0,NULL);
+	return(0);
+	}
+
+// call the go handler function which returns the verdict and the new mark
+// along with a rewritten packet if a plugin changed the packet
+newpkt = NULL;
+newlen = 0;
+verdict = go_netfilter_callback(queue->index,omark,rawpkt,rawlen,&nmark,&newpkt,&newlen);
 
-// set the verdict and the returned mark
-nfq_set_verdict2(qh,(hdr ? ntohl(hdr->packet_id) : 0),NF_ACCEPT,nmark,0,NULL);
+// set the verdict and the returned mark and packet
+nfq_set_verdict2(qh,(hdr ? ntohl(hdr->packet_id) : 0),verdict,nmark,newlen,newpkt);
+
+// the rewritten packet is allocated by the go handler
+if (newpkt != NULL) free(newpkt);
 
 return(0);
 }
 /*--------------------------------------------------------------------------*/
-static int netfilter_startup(void)
+static void netfilter_configure(int first,int count,int sock_buffer,int net_maxlen,int net_buffer)
+{
+struct nfq_handle	*handle;
+
+// the values are validated on the go side before we are called
+cfg_net_queue = first;
+cfg_net_count = count;
+cfg_sock_buffer = sock_buffer;
+cfg_net_maxlen = net_maxlen;
+cfg_net_buffer = net_buffer;
+if (cfg_net_count < 1) cfg_net_count = 1;
+if (cfg_net_count > NETFILTER_MAX_QUEUES) cfg_net_count = NETFILTER_MAX_QUEUES;
+
+logmessage(LOG_INFO,"Netfilter queue %d count %d sock_buffer %d maxlen %d buffer %d\n",cfg_net_queue,cfg_net_count,cfg_sock_buffer,cfg_net_maxlen,cfg_net_buffer);
+
+// On older kernels unbinding a protocol family removes it for every handle
+// so we do it once here rather than in each queue thread where it would
+// break the queues that were already started.
+handle = nfq_open();
+
+	if (handle == NULL)
+	{
+	logmessage(LOG_ERR,"Error returned from nfq_open()\n");
+	return;
+	}
+
+if (nfq_unbind_pf(handle,AF_INET) < 0) logmessage(LOG_ERR,"Error returned from nfq_unbind_pf(AF_INET)\n");
+if (nfq_unbind_pf(handle,AF_INET6) < 0) logmessage(LOG_ERR,"Error returned from nfq_unbind_pf(AF_INET6)\n");
+
+nfq_close(handle);
+}
+/*--------------------------------------------------------------------------*/
+static int netfilter_startup(struct netfilter_queue *queue)
 {
 int		ret;
 
 //open a new netfilter queue handler
-nfqh = nfq_open();
+queue->nfqh = nfq_open();
 
-	if (nfqh == NULL)
+	if (queue->nfqh == NULL)
 	{
 	logmessage(LOG_ERR,"Error returned from nfq_open()\n");
 	g_shutdown = 1;
 	return(1);
 	}
 
-// unbind any existing queue handler
-ret = nfq_unbind_pf(nfqh,AF_INET);
+// bind the queue handler for AF_INET
+ret = nfq_bind_pf(queue->nfqh,AF_INET);
 
 	if (ret < 0)
 	{
-	logmessage(LOG_ERR,"Error returned from nfq_unbind_pf()\n");
+	logmessage(LOG_ERR,"Error returned from nfq_bind_pf(AF_INET)\n");
 	g_shutdown = 1;
-	return(2);
+	return(3);
 	}
 
-// bind the queue handler for AF_INET
-ret = nfq_bind_pf(nfqh,AF_INET);
+// bind the queue handler for AF_INET6
+ret = nfq_bind_pf(queue->nfqh,AF_INET6);
 
 	if (ret < 0)
 	{
-	logmessage(LOG_ERR,"Error returned from nfq_bind_pf(lan)\n");
+	logmessage(LOG_ERR,"Error returned from nfq_bind_pf(AF_INET6)\n");
 	g_shutdown = 1;
 	return(3);
 	}
 
 // create a new netfilter queue
-nfqqh = nfq_create_queue(nfqh,cfg_net_queue,netq_callback,NULL);
+queue->nfqqh = nfq_create_queue(queue->nfqh,queue->number,netq_callback,queue);
 
-	if (nfqqh == 0)
+	if (queue->nfqqh == 0)
 	{
-	logmessage(LOG_ERR,"Error returned from nfq_create_queue(%u)\n",cfg_net_queue);
+	logmessage(LOG_ERR,"Error returned from nfq_create_queue(%u)\n",queue->number);
 	g_shutdown = 1;
 	return(4);
 	}
 
 // set the queue length
-ret = nfq_set_queue_maxlen(nfqqh,cfg_net_maxlen);
+ret = nfq_set_queue_maxlen(queue->nfqqh,cfg_net_maxlen);
 
 	if (ret < 0)
 	{
@@ -115,7 +184,7 @@ ret = nfq_set_queue_maxlen(nfqqh,cfg_net_maxlen);
 	}
 
 // set the queue data copy mode
-ret = nfq_set_mode(nfqqh,NFQNL_COPY_PACKET,cfg_net_buffer);
+ret = nfq_set_mode(queue->nfqqh,NFQNL_COPY_PACKET,cfg_net_buffer);
 
 	if (ret < 0)
 	{
@@ -124,35 +193,75 @@ ret = nfq_set_mode(nfqqh,NFQNL_COPY_PACKET,cfg_net_buffer);
 	return(6);
 	}
 
+// accept packets instead of dropping them when the queue is full but
+// keep going on older kernels that do not support the flag
+ret = nfq_set_queue_flags(queue->nfqqh,NFQA_CFG_F_FAIL_OPEN,NFQA_CFG_F_FAIL_OPEN);
+if (ret < 0) logmessage(LOG_WARNING,"Error returned from nfq_set_queue_flags(NFQA_CFG_F_FAIL_OPEN)\n");
+
 return(0);
 }
 /*--------------------------------------------------------------------------*/
-static void netfilter_shutdown(void)
+static void netfilter_shutdown(struct netfilter_queue *queue)
 {
 // destroy the netfilter queue
-nfq_destroy_queue(nfqqh);
+if (queue->nfqqh != NULL) nfq_destroy_queue(queue->nfqqh);
+queue->nfqqh = NULL;
 
 // shut down the netfilter queue handler
-nfq_close(nfqh);
+if (queue->nfqh != NULL) nfq_close(queue->nfqh);
+queue->nfqh = NULL;
+}
+/*--------------------------------------------------------------------------*/
+static void netfilter_affinity(struct netfilter_queue *queue)
+{
+cpu_set_t	cpuset;
+long		count;
+int			ret;
+
+// with --queue-cpu-fanout the kernel picks the queue using the CPU number
+// modulo the number of queues so we run each queue on the matching CPU
+count = sysconf(_SC_NPROCESSORS_ONLN);
+if (count < 1) return;
+
+CPU_ZERO(&cpuset);
+CPU_SET(queue->index % count,&cpuset);
+
+ret = pthread_setaffinity_np(pthread_self(),sizeof(cpuset),&cpuset);
+if (ret != 0) logmessage(LOG_WARNING,"Error %d returned from pthread_setaffinity_np(%d)\n",ret,(int)(queue->index % count));
 }
 /*--------------------------------------------------------------------------*/
-static int netfilter_thread(void)
+static int netfilter_thread(int index)
 {
+struct netfilter_queue	*queue;
 struct pollfd	network,console;
 struct timeval	tv;
 char			*buffer;
 int				netsock;
 int				val,ret;
 
-gettimeofday(&g_runtime,NULL);
+if ((index < 0) || (index >= cfg_net_count)) return(1);
+
+queue = &queue_list[index];
+queue->index = index;
+queue->number = (cfg_net_queue + index);
 
-logmessage(LOG_INFO,"The netfilter thread is starting\n");
+logmessage(LOG_INFO,"The netfilter thread for queue %d is starting\n",queue->number);
+
+// run on the CPU that feeds our queue
+netfilter_affinity(queue);
 
 // allocate our packet buffer
 buffer = (char *)malloc(cfg_net_buffer);
 
+	if (buffer == NULL)
+	{
+	logmessage(LOG_ERR,"Unable to allocate the netfilter buffer\n");
+	g_shutdown = 1;
+	return(1);
+	}
+
 // call our netfilter startup function
-ret = netfilter_startup();
+ret = netfilter_startup(queue);
 
 	if (ret != 0)
 	{
@@ -162,7 +271,7 @@ ret = netfilter_startup();
 	}
 
 // get the socket descriptor for the netlink queue
-netsock = nfnl_fd(nfq_nfnlh(nfqh));
+netsock = nfnl_fd(nfq_nfnlh(queue->nfqh));
 
 	// set the socket receive buffer size if config value is not zero
 	if (cfg_sock_buffer != 0)
@@ -183,8 +292,6 @@ network.fd = netsock;
 network.events = POLLIN;
 network.revents = 0;
 
-go_child_startup();
-
 	while (g_shutdown == 0)
 	{
 	// wait for data on the socket
@@ -215,25 +322,44 @@ go_child_startup();
 
 			if (ret < 0)
 			{
-			if ((errno == EAGAIN) || (errno == EINTR) || (errno == ENOBUFS)) break;
+			if ((errno == EAGAIN) || (errno == EINTR)) break;
+
+				// the kernel could not deliver packets because our socket
+				// buffer was full so tell the go side we are falling behind
+				if (errno == ENOBUFS)
+				{
+				go_netfilter_overload(index);
+				break;
+				}
+
 			logmessage(LOG_ERR,"Error %d (%s) returned from recv()\n",errno,strerror(errno));
 			g_shutdown = 1;
 			break;
 			}
 
 			// pass the data to the packet handler
-			nfq_handle_packet(nfqh,buffer,ret);
+			nfq_handle_packet(queue->nfqh,buffer,ret);
+
+			// if plugin handlers are still using the buffer it now belongs
+			// to the go side which will free it so we need a new one
+			if (go_netfilter_retained(index,buffer) != 0) buffer = (char *)malloc(cfg_net_buffer);
+
+				if (buffer == NULL)
+				{
+				logmessage(LOG_ERR,"Unable to allocate a new netfilter buffer\n");
+				g_shutdown = 1;
+				break;
+				}
 		} while (ret > 0);
 	}
 
 // call our netfilter shutdown function
-netfilter_shutdown();
+netfilter_shutdown(queue);
 
 // free our packet buffer memory
 free(buffer);
 
-logmessage(LOG_INFO,"The netfilter thread has terminated\n");
-go_child_goodbye();
+logmessage(LOG_INFO,"The netfilter thread for queue %d has terminated\n",queue->number);
 return(0);
 }
 /*--------------------------------------------------------------------------*/
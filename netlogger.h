@@ -10,18 +10,17 @@
 /*--------------------------------------------------------------------------*/
 struct netlogger_info
 {
+	u_int8_t	family;
 	u_int8_t	protocol;
 	u_int16_t	icmp_type;
 	u_int8_t	src_intf, dst_intf;
-	u_int32_t	src_addr, dst_addr;
+	u_int8_t	src_addr[16], dst_addr[16];
 	u_int16_t	src_port, dst_port;
 	u_int32_t	mark;
 	const char	*prefix;
 };
 /*--------------------------------------------------------------------------*/
 extern void go_netlogger_callback(struct netlogger_info* info);
-extern void go_child_startup(void);
-extern void go_child_goodbye(void);
 /*--------------------------------------------------------------------------*/
 static struct nflog_handle		*l_log_handle;
 static struct nflog_g_handle	*l_grp_handle;
@@ -30,12 +29,15 @@ static int						l_logsock;
 static int netlogger_callback(struct nflog_g_handle *gh,struct nfgenmsg *nfmsg,struct nflog_data *nfa,void *data)
 {
 struct netlogger_info	info;
+struct icmp6_hdr		*icmp6head;
 struct icmphdr			*icmphead;
 struct tcphdr			*tcphead;
 struct udphdr			*udphead;
+struct ip6_hdr			*ip6head;
 struct iphdr			*iphead;
 char					*packet_data;
 int						packet_size;
+int						offset;
 
 // get the raw packet and check for sanity
 packet_size = nflog_get_payload(nfa,&packet_data);
@@ -50,18 +52,40 @@ info.mark = nflog_get_nfmark(nfa);
 info.src_intf = (info.mark & 0xFF);
 info.dst_intf = ((info.mark & 0xFF00) >> 8);
 
-// set up the IP, TCP, and UDP headers for parsing
+// use the iphdr structure to find the IP version
 iphead = (struct iphdr *)packet_data;
-tcphead = (struct tcphdr *)&packet_data[iphead->ihl << 2];
-udphead = (struct udphdr *)&packet_data[iphead->ihl << 2];
-icmphead = (struct icmphdr *)&packet_data[iphead->ihl << 2];
+ip6head = (struct ip6_hdr *)packet_data;
+memset(info.src_addr,0,sizeof(info.src_addr));
+memset(info.dst_addr,0,sizeof(info.dst_addr));
 
-// grab the protocol
-info.protocol = iphead->protocol;
+	// grab the protocol and the source and destination addresses which
+	// are in network byte order and find the start of the next header
+	switch(iphead->version)
+	{
+	case 4:
+		info.family = AF_INET;
+		info.protocol = iphead->protocol;
+		memcpy(info.src_addr,&iphead->saddr,4);
+		memcpy(info.dst_addr,&iphead->daddr,4);
+		offset = (iphead->ihl << 2);
+		break;
+	case 6:
+		if (packet_size < (int)sizeof(struct ip6_hdr)) return(0);
+		info.family = AF_INET6;
+		info.protocol = ip6head->ip6_nxt;
+		memcpy(info.src_addr,&ip6head->ip6_src,16);
+		memcpy(info.dst_addr,&ip6head->ip6_dst,16);
+		offset = sizeof(struct ip6_hdr);
+		break;
+	default:
+		return(0);
+	}
 
-// grab the source and destination addresses
-info.src_addr = iphead->saddr;
-info.dst_addr = iphead->daddr;
+// set up the ICMP, TCP, and UDP headers for parsing
+tcphead = (struct tcphdr *)&packet_data[offset];
+udphead = (struct udphdr *)&packet_data[offset];
+icmphead = (struct icmphdr *)&packet_data[offset];
+icmp6head = (struct icmp6_hdr *)&packet_data[offset];
 
 // Since 0 is a valid ICMP type we use 999 to signal null or unknown
 info.src_port = info.dst_port = 0;
@@ -72,6 +96,9 @@ info.icmp_type = 999;
 	case IPPROTO_ICMP:
 		info.icmp_type = icmphead->type;
 		break;
+	case IPPROTO_ICMPV6:
+		info.icmp_type = icmp6head->icmp6_type;
+		break;
 	case IPPROTO_TCP:
 		info.src_port = ntohs(tcphead->source);
 		info.dst_port = ntohs(tcphead->dest);
@@ -118,6 +145,24 @@ ret = nflog_bind_pf(l_log_handle,AF_INET);
 	return(3);
 	}
 
+// unbind any existing AF_INET6 handler
+ret = nflog_unbind_pf(l_log_handle,AF_INET6);
+
+	if (ret < 0)
+	{
+	logmessage(LOG_ERR,"Error %d returned from nflog_unbind_pf(AF_INET6)\n",errno);
+	return(2);
+	}
+
+// bind us as the AF_INET6 handler
+ret = nflog_bind_pf(l_log_handle,AF_INET6);
+
+	if (ret < 0)
+	{
+	logmessage(LOG_ERR,"Error %d returned from nflog_bind_pf(AF_INET6)\n",errno);
+	return(3);
+	}
+
 // bind our log handle to group zero
 l_grp_handle = nflog_bind_group(l_log_handle,0);
 
@@ -192,8 +237,6 @@ ret = netlogger_startup();
 	g_shutdown = 1;
 	}
 
-go_child_startup();
-
 	// sit in this loop processing messages from the queue
 	while (g_shutdown == 0)
 	{
@@ -238,7 +281,6 @@ go_child_startup();
 netlogger_shutdown();
 
 logmessage(LOG_INFO,"The netlogger thread has terminated\n");
-go_child_goodbye();
 return(0);
 }
 /*--------------------------------------------------------------------------*/
@@ -0,0 +1,366 @@
+package nfnetlink
+
+import "net"
+import "syscall"
+
+/*---------------------------------------------------------------------------*/
+
+// values from linux/netfilter/nfnetlink_conntrack.h
+const (
+	ctMsgNew    = 0
+	ctMsgGet    = 1
+	ctMsgDelete = 2
+)
+
+const (
+	ctAttrTupleOrig    = 1
+	ctAttrTupleReply   = 2
+	ctAttrStatus       = 3
+	ctAttrProtoinfo    = 4
+	ctAttrTimeout      = 7
+	ctAttrMark         = 8
+	ctAttrCountersOrig = 9
+	ctAttrCountersRepl = 10
+	ctAttrZone         = 18
+	ctAttrMarkMask     = 21
+	ctAttrLabels       = 22
+	ctAttrLabelsMask   = 23
+)
+
+const (
+	ctTupleIP    = 1
+	ctTupleProto = 2
+)
+
+const (
+	ctIPv4Src = 1
+	ctIPv4Dst = 2
+	ctIPv6Src = 3
+	ctIPv6Dst = 4
+)
+
+const (
+	ctProtoNum     = 1
+	ctProtoSrcPort = 2
+	ctProtoDstPort = 3
+)
+
+const (
+	ctCounterPackets   = 1
+	ctCounterBytes     = 2
+	ctCounter32Packets = 3
+	ctCounter32Bytes   = 4
+)
+
+const (
+	ctProtoinfoTCP      = 1
+	ctProtoinfoTCPState = 1
+)
+
+// the multicast groups from linux/netfilter/nfnetlink.h
+const (
+	GroupConntrackNew     = 1
+	GroupConntrackUpdate  = 2
+	GroupConntrackDestroy = 3
+)
+
+// the conntrack event types
+const (
+	ConntrackNew     = 'N'
+	ConntrackUpdate  = 'U'
+	ConntrackDestroy = 'D'
+)
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Conntrack receives conntrack events and the results of table dumps.
+ */
+type Conntrack struct {
+	sock *Socket
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ConntrackTuple is the tuple for one direction of a connection. The reply
+ * tuple has the addresses and ports after NAT.
+ */
+type ConntrackTuple struct {
+	Protocol uint8
+	SrcAddr  net.IP
+	DstAddr  net.IP
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ConntrackEvent holds the tuples, counters, and state for a conntrack
+ * event. The counters are only set when conntrack accounting is enabled,
+ * and the kernel only sends them with destroy events and dump results, so
+ * HasCounters tells if the event had them. The TCP state is only set for
+ * TCP, and the timeout is in seconds.
+ */
+type ConntrackEvent struct {
+	Type        int
+	Family      uint8
+	Orig        ConntrackTuple
+	Reply       ConntrackTuple
+	OrigPackets uint64
+	OrigBytes   uint64
+	ReplPackets uint64
+	ReplBytes   uint64
+	HasCounters bool
+	Mark        uint32
+	Zone        uint16
+	Status      uint32
+	TCPState    uint8
+	Timeout     uint32
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ConntrackChange holds the connmark and label bits to change with
+ * UpdateConntrack. Only the bits set in the masks are changed, and label
+ * bit n is bit n%32 of word n/32.
+ */
+type ConntrackChange struct {
+	Mark      uint32
+	MarkMask  uint32
+	Labels    [4]uint32
+	LabelMask [4]uint32
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * OpenConntrack subscribes to the conntrack events for the given groups.
+ */
+func OpenConntrack(groups ...int) (*Conntrack, error) {
+	var mask uint32
+
+	for _, group := range groups {
+		mask |= (1 << uint(group-1))
+	}
+
+	sock, err := Open(mask)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conntrack{sock: sock}, nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Dump asks the kernel for every entry in the conntrack table. The entries
+ * are returned by Receive as update events. It is safe to call Dump while
+ * another goroutine is waiting in Receive.
+ */
+func (ct *Conntrack) Dump() error {
+	return ct.sock.Send(subsysCtnetlink, ctMsgGet, syscall.NLM_F_DUMP, syscall.AF_UNSPEC, 0, nil)
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *Conntrack) Receive(buffer []byte) ([]ConntrackEvent, error) {
+	messages, err := ct.sock.Receive(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []ConntrackEvent
+
+	for _, message := range messages {
+		if message.Subsys != subsysCtnetlink {
+			continue
+		}
+
+		var event ConntrackEvent
+
+		// a new message is an update unless it has the create flags
+		switch message.Type {
+		case ctMsgNew:
+			if (message.Flags & (syscall.NLM_F_CREATE | syscall.NLM_F_EXCL)) != 0 {
+				event.Type = ConntrackNew
+			} else {
+				event.Type = ConntrackUpdate
+			}
+		case ctMsgDelete:
+			event.Type = ConntrackDestroy
+		default:
+			continue
+		}
+
+		event.Family = message.Family
+		event.Orig = parseTuple(message.Attrs[ctAttrTupleOrig])
+		event.Reply = parseTuple(message.Attrs[ctAttrTupleReply])
+
+		_, event.HasCounters = message.Attrs[ctAttrCountersOrig]
+		orig := ParseAttributes(message.Attrs[ctAttrCountersOrig])
+		repl := ParseAttributes(message.Attrs[ctAttrCountersRepl])
+		event.OrigPackets = getCounter(orig, ctCounterPackets, ctCounter32Packets)
+		event.OrigBytes = getCounter(orig, ctCounterBytes, ctCounter32Bytes)
+		event.ReplPackets = getCounter(repl, ctCounterPackets, ctCounter32Packets)
+		event.ReplBytes = getCounter(repl, ctCounterBytes, ctCounter32Bytes)
+
+		event.Mark = getBe32(message.Attrs, ctAttrMark)
+		event.Zone = getBe16(message.Attrs, ctAttrZone)
+		event.Status = getBe32(message.Attrs, ctAttrStatus)
+		event.Timeout = getBe32(message.Attrs, ctAttrTimeout)
+
+		protoinfo := ParseAttributes(message.Attrs[ctAttrProtoinfo])
+		if value := ParseAttributes(protoinfo[ctProtoinfoTCP])[ctProtoinfoTCPState]; len(value) >= 1 {
+			event.TCPState = value[0]
+		}
+
+		list = append(list, event)
+	}
+
+	return list, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (ct *Conntrack) Close() error {
+	return ct.sock.Close()
+}
+
+/*---------------------------------------------------------------------------*/
+func parseTuple(data []byte) ConntrackTuple {
+	var result ConntrackTuple
+
+	tuple := ParseAttributes(data)
+	addrs := ParseAttributes(tuple[ctTupleIP])
+	proto := ParseAttributes(tuple[ctTupleProto])
+
+	if value := addrs[ctIPv4Src]; len(value) == net.IPv4len {
+		result.SrcAddr = net.IP(append([]byte(nil), value...))
+	}
+	if value := addrs[ctIPv4Dst]; len(value) == net.IPv4len {
+		result.DstAddr = net.IP(append([]byte(nil), value...))
+	}
+	if value := addrs[ctIPv6Src]; len(value) == net.IPv6len {
+		result.SrcAddr = net.IP(append([]byte(nil), value...))
+	}
+	if value := addrs[ctIPv6Dst]; len(value) == net.IPv6len {
+		result.DstAddr = net.IP(append([]byte(nil), value...))
+	}
+
+	if value := proto[ctProtoNum]; len(value) >= 1 {
+		result.Protocol = value[0]
+	}
+	result.SrcPort = getBe16(proto, ctProtoSrcPort)
+	result.DstPort = getBe16(proto, ctProtoDstPort)
+	return (result)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Very old kernels send 32 bit counters instead of 64 bit.
+ */
+func getCounter(attrs map[uint16][]byte, kind uint16, kind32 uint16) uint64 {
+	if _, ok := attrs[kind]; ok {
+		return getBe64(attrs, kind)
+	}
+	return uint64(getBe32(attrs, kind32))
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * DestroyConntrack removes the conntrack entry for a tuple in the default
+ * zone. The kernel finds the entry with the tuple in either direction.
+ */
+func DestroyConntrack(tuple ConntrackTuple) error {
+	sock, err := Open(0)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	attrs := appendNested(nil, ctAttrTupleOrig, buildTuple(tuple))
+	return sock.Execute(subsysCtnetlink, ctMsgDelete, tupleFamily(tuple), 0, attrs)
+}
+
+/*---------------------------------------------------------------------------*/
+func buildTuple(tuple ConntrackTuple) []byte {
+	var addrs []byte
+
+	if tupleFamily(tuple) == syscall.AF_INET {
+		addrs = AppendAttribute(addrs, ctIPv4Src, tuple.SrcAddr.To4())
+		addrs = AppendAttribute(addrs, ctIPv4Dst, tuple.DstAddr.To4())
+	} else {
+		addrs = AppendAttribute(addrs, ctIPv6Src, tuple.SrcAddr.To16())
+		addrs = AppendAttribute(addrs, ctIPv6Dst, tuple.DstAddr.To16())
+	}
+
+	proto := AppendAttribute(nil, ctProtoNum, []byte{tuple.Protocol})
+	proto = AppendAttribute(proto, ctProtoSrcPort, be16(tuple.SrcPort))
+	proto = AppendAttribute(proto, ctProtoDstPort, be16(tuple.DstPort))
+
+	data := appendNested(nil, ctTupleIP, addrs)
+	return appendNested(data, ctTupleProto, proto)
+}
+
+/*---------------------------------------------------------------------------*/
+func tupleFamily(tuple ConntrackTuple) uint8 {
+	if (tuple.SrcAddr.To4() != nil) && (tuple.DstAddr.To4() != nil) {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * UpdateConntrack changes the connmark and labels of the conntrack entry for
+ * a tuple in the default zone. A new message without the create flag only
+ * updates an existing entry. The kernel keeps the bits outside the masks,
+ * and it fails with ENOSPC when labels are given for an entry that has no
+ * room for them.
+ */
+func UpdateConntrack(tuple ConntrackTuple, change ConntrackChange) error {
+	sock, err := Open(0)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	return sock.Execute(subsysCtnetlink, ctMsgNew, tupleFamily(tuple), 0, buildChange(tuple, change))
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The mark is always sent with the mark mask so the kernel changes only the
+ * masked bits in one step, which keeps any bits set at the same time by the
+ * CONNMARK target.
+ */
+func buildChange(tuple ConntrackTuple, change ConntrackChange) []byte {
+	attrs := appendNested(nil, ctAttrTupleOrig, buildTuple(tuple))
+
+	if change.MarkMask != 0 {
+		attrs = AppendAttribute(attrs, ctAttrMark, be32(change.Mark&change.MarkMask))
+		attrs = AppendAttribute(attrs, ctAttrMarkMask, be32(change.MarkMask))
+	}
+
+	// the labels are sent as words in host byte order
+	if change.LabelMask != [4]uint32{} {
+		labels := make([]byte, 4*len(change.Labels))
+		mask := make([]byte, 4*len(change.LabelMask))
+		for i := range change.LabelMask {
+			nativeEndian.PutUint32(labels[4*i:], change.Labels[i]&change.LabelMask[i])
+			nativeEndian.PutUint32(mask[4*i:], change.LabelMask[i])
+		}
+		attrs = AppendAttribute(attrs, ctAttrLabels, labels)
+		attrs = AppendAttribute(attrs, ctAttrLabelsMask, mask)
+	}
+
+	return (attrs)
+}
+
+/*---------------------------------------------------------------------------*/
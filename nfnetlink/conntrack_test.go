@@ -0,0 +1,114 @@
+package nfnetlink
+
+import "net"
+import "syscall"
+import "testing"
+
+/*---------------------------------------------------------------------------*/
+func TestParseTuple(t *testing.T) {
+	for _, tuple := range []ConntrackTuple{
+		{Protocol: 6, SrcAddr: net.ParseIP("10.0.0.1").To4(), DstAddr: net.ParseIP("10.0.0.2").To4(), SrcPort: 40000, DstPort: 443},
+		{Protocol: 17, SrcAddr: net.ParseIP("2001:db8::1"), DstAddr: net.ParseIP("2001:db8::2"), SrcPort: 5353, DstPort: 53},
+	} {
+		result := parseTuple(buildTuple(tuple))
+		if (result.Protocol != tuple.Protocol) || !result.SrcAddr.Equal(tuple.SrcAddr) || !result.DstAddr.Equal(tuple.DstAddr) || (result.SrcPort != tuple.SrcPort) || (result.DstPort != tuple.DstPort) {
+			t.Errorf("tuple %+v was parsed as %+v", tuple, result)
+		}
+		if len(result.SrcAddr) != len(tuple.SrcAddr) {
+			t.Errorf("address %v was parsed with length %d", tuple.SrcAddr, len(result.SrcAddr))
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestConntrackReceiveWithoutCounters(t *testing.T) {
+	orig := ConntrackTuple{Protocol: 17, SrcAddr: net.ParseIP("192.168.1.10").To4(), DstAddr: net.ParseIP("203.0.113.5").To4(), SrcPort: 5353, DstPort: 53}
+	attrs := appendNested(nil, ctAttrTupleOrig, buildTuple(orig))
+
+	ct := &Conntrack{sock: &Socket{pending: [][]byte{buildMessage(subsysCtnetlink, ctMsgNew, 0, 0, syscall.AF_INET, 0, attrs)}}}
+
+	list, err := ct.Receive(nil)
+	if (err != nil) || (len(list) != 1) {
+		t.Fatalf("Receive returned %v %v", list, err)
+	}
+	if list[0].HasCounters {
+		t.Errorf("an event without counters has counters")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestConntrackReceive(t *testing.T) {
+	orig := ConntrackTuple{Protocol: 6, SrcAddr: net.ParseIP("192.168.1.10").To4(), DstAddr: net.ParseIP("203.0.113.5").To4(), SrcPort: 40000, DstPort: 80}
+	reply := ConntrackTuple{Protocol: 6, SrcAddr: net.ParseIP("203.0.113.5").To4(), DstAddr: net.ParseIP("198.51.100.1").To4(), SrcPort: 80, DstPort: 61000}
+
+	counters := AppendAttribute(nil, ctCounterPackets, []byte{0, 0, 0, 0, 0, 0, 0, 12})
+	counters = AppendAttribute(counters, ctCounterBytes, []byte{0, 0, 0, 0, 0, 0, 0x10, 0})
+	tcpinfo := appendNested(nil, ctProtoinfoTCP, AppendAttribute(nil, ctProtoinfoTCPState, []byte{3}))
+
+	attrs := appendNested(nil, ctAttrTupleOrig, buildTuple(orig))
+	attrs = appendNested(attrs, ctAttrTupleReply, buildTuple(reply))
+	attrs = appendNested(attrs, ctAttrCountersOrig, counters)
+	attrs = appendNested(attrs, ctAttrCountersRepl, AppendAttribute(nil, ctCounter32Packets, be32(7)))
+	attrs = appendNested(attrs, ctAttrProtoinfo, tcpinfo)
+	attrs = AppendAttribute(attrs, ctAttrMark, be32(0x10000001))
+	attrs = AppendAttribute(attrs, ctAttrStatus, be32(0x18E))
+	attrs = AppendAttribute(attrs, ctAttrTimeout, be32(120))
+
+	ct := &Conntrack{sock: &Socket{pending: [][]byte{
+		buildMessage(subsysCtnetlink, ctMsgNew, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, 0, syscall.AF_INET, 0, attrs),
+		buildMessage(subsysCtnetlink, ctMsgNew, 0, 0, syscall.AF_INET, 0, attrs),
+		buildMessage(subsysCtnetlink, ctMsgDelete, 0, 0, syscall.AF_INET, 0, attrs),
+	}}}
+
+	for _, kind := range []int{ConntrackNew, ConntrackUpdate, ConntrackDestroy} {
+		list, err := ct.Receive(nil)
+		if (err != nil) || (len(list) != 1) {
+			t.Fatalf("Receive returned %v %v", list, err)
+		}
+
+		event := list[0]
+		if event.Type != kind {
+			t.Errorf("the event type is %c instead of %c", event.Type, kind)
+		}
+		if !event.Orig.SrcAddr.Equal(orig.SrcAddr) || (event.Reply.DstPort != reply.DstPort) {
+			t.Errorf("the tuples are %+v and %+v", event.Orig, event.Reply)
+		}
+		if !event.HasCounters || (event.OrigPackets != 12) || (event.OrigBytes != 0x1000) || (event.ReplPackets != 7) || (event.ReplBytes != 0) {
+			t.Errorf("the counters are %d %d %d %d", event.OrigPackets, event.OrigBytes, event.ReplPackets, event.ReplBytes)
+		}
+		if (event.Mark != 0x10000001) || (event.Status != 0x18E) || (event.Timeout != 120) || (event.TCPState != 3) {
+			t.Errorf("the event is %+v", event)
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestBuildChange(t *testing.T) {
+	tuple := ConntrackTuple{Protocol: 6, SrcAddr: net.ParseIP("10.0.0.1").To4(), DstAddr: net.ParseIP("10.0.0.2").To4(), SrcPort: 40000, DstPort: 443}
+
+	change := ConntrackChange{Mark: 0xFFFF0000, MarkMask: 0x00FF0000}
+	attrs := ParseAttributes(buildChange(tuple, change))
+	if (getBe32(attrs, ctAttrMark) != 0x00FF0000) || (getBe32(attrs, ctAttrMarkMask) != 0x00FF0000) {
+		t.Errorf("the mark is %v with mask %v", attrs[ctAttrMark], attrs[ctAttrMarkMask])
+	}
+	if _, ok := attrs[ctAttrLabels]; ok {
+		t.Errorf("labels were sent without a label mask")
+	}
+	if result := parseTuple(attrs[ctAttrTupleOrig]); result.SrcPort != 40000 {
+		t.Errorf("the tuple is %+v", result)
+	}
+
+	change = ConntrackChange{Labels: [4]uint32{0, 0x3, 0, 0}, LabelMask: [4]uint32{0, 0x1, 0, 0}}
+	attrs = ParseAttributes(buildChange(tuple, change))
+	if _, ok := attrs[ctAttrMarkMask]; ok {
+		t.Errorf("a mark was sent without a mark mask")
+	}
+	if labels := attrs[ctAttrLabels]; (len(labels) != 16) || (nativeEndian.Uint32(labels[4:]) != 0x1) {
+		t.Errorf("the labels are %v", labels)
+	}
+	if mask := attrs[ctAttrLabelsMask]; (len(mask) != 16) || (nativeEndian.Uint32(mask[4:]) != 0x1) {
+		t.Errorf("the label mask is %v", mask)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,141 @@
+package nfnetlink
+
+import "fmt"
+import "bytes"
+import "syscall"
+import "encoding/binary"
+
+/*---------------------------------------------------------------------------*/
+
+// values from linux/netfilter/nfnetlink_log.h
+const (
+	logMsgPacket = 0
+	logMsgConfig = 1
+)
+
+const (
+	logAttrMark    = 2
+	logAttrPayload = 9
+	logAttrPrefix  = 10
+)
+
+const (
+	logCfgCmd     = 1
+	logCfgMode    = 2
+	logCfgNlbufsz = 3
+)
+
+const (
+	logCmdBind     = 1
+	logCmdUnbind   = 2
+	logCmdPfBind   = 3
+	logCmdPfUnbind = 4
+)
+
+const logCopyPacket = 2
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Log receives the packets sent to a netfilter log group.
+ */
+type Log struct {
+	sock  *Socket
+	group uint16
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * LogPacket is a packet from the log group. The Payload points into the
+ * buffer passed to Receive.
+ */
+type LogPacket struct {
+	Mark    uint32
+	Prefix  string
+	Payload []byte
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * OpenLog binds to a log group and asks for the first copyRange bytes of
+ * each packet, with the kernel batching up to bufferSize bytes of messages.
+ */
+func OpenLog(group uint16, copyRange uint32, bufferSize uint32) (*Log, error) {
+	sock, err := Open(0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		for _, command := range []uint8{logCmdPfUnbind, logCmdPfBind} {
+			err = sock.Execute(subsysUlog, logMsgConfig, family, 0, AppendAttribute(nil, logCfgCmd, []byte{command}))
+			if err != nil {
+				sock.Close()
+				return nil, fmt.Errorf("bind family %d: %s", family, err)
+			}
+		}
+	}
+
+	err = sock.Execute(subsysUlog, logMsgConfig, syscall.AF_UNSPEC, group, AppendAttribute(nil, logCfgCmd, []byte{logCmdBind}))
+	if err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("bind group %d: %s", group, err)
+	}
+
+	log := &Log{sock: sock, group: group}
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, copyRange)
+	mode[4] = logCopyPacket
+	attrs := AppendAttribute(nil, logCfgMode, mode)
+	attrs = AppendAttribute(attrs, logCfgNlbufsz, be32(bufferSize))
+
+	err = sock.Execute(subsysUlog, logMsgConfig, syscall.AF_UNSPEC, group, attrs)
+	if err != nil {
+		log.Close()
+		return nil, fmt.Errorf("configure group %d: %s", group, err)
+	}
+
+	return log, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (log *Log) Receive(buffer []byte) ([]LogPacket, error) {
+	messages, err := log.sock.Receive(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []LogPacket
+
+	for _, message := range messages {
+		if (message.Subsys != subsysUlog) || (message.Type != logMsgPacket) {
+			continue
+		}
+
+		var packet LogPacket
+		packet.Mark = getBe32(message.Attrs, logAttrMark)
+		packet.Payload = message.Attrs[logAttrPayload]
+
+		// the prefix includes the null terminator
+		prefix := message.Attrs[logAttrPrefix]
+		if index := bytes.IndexByte(prefix, 0); index >= 0 {
+			prefix = prefix[:index]
+		}
+		packet.Prefix = string(prefix)
+
+		list = append(list, packet)
+	}
+
+	return list, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (log *Log) Close() error {
+	log.sock.Send(subsysUlog, logMsgConfig, 0, syscall.AF_UNSPEC, log.group, AppendAttribute(nil, logCfgCmd, []byte{logCmdUnbind}))
+	return log.sock.Close()
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,220 @@
+package nfnetlink
+
+import "fmt"
+import "syscall"
+import "encoding/binary"
+
+/*---------------------------------------------------------------------------*/
+
+// values from linux/netfilter/nfnetlink_queue.h
+const (
+	queueMsgPacket  = 0
+	queueMsgVerdict = 1
+	queueMsgConfig  = 2
+)
+
+const (
+	queueAttrPacketHdr  = 1
+	queueAttrVerdictHdr = 2
+	queueAttrMark       = 3
+	queueAttrPayload    = 10
+)
+
+const (
+	queueCfgCmd    = 1
+	queueCfgParams = 2
+	queueCfgMaxlen = 3
+	queueCfgMask   = 4
+	queueCfgFlags  = 5
+)
+
+const (
+	queueCmdBind     = 1
+	queueCmdUnbind   = 2
+	queueCmdPfBind   = 3
+	queueCmdPfUnbind = 4
+)
+
+const queueCopyPacket = 2
+const queueFlagFailOpen = 1
+
+// the verdict values from linux/netfilter.h
+const (
+	VerdictDrop   = 0
+	VerdictAccept = 1
+	VerdictRepeat = 4
+)
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Queue receives packets from one netfilter queue and returns the verdicts.
+ */
+type Queue struct {
+	sock   *Socket
+	number uint16
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Packet is a packet from the queue. The Payload points into the buffer
+ * passed to Receive.
+ */
+type Packet struct {
+	Id      uint32
+	Mark    uint32
+	Payload []byte
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * UnbindQueueFamilies removes any existing queue handler for IPv4 and IPv6.
+ * This is only needed on old kernels and is done once before any queues
+ * are opened since it affects every queue.
+ */
+func UnbindQueueFamilies() error {
+	sock, err := Open(0)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		err = sock.Execute(subsysQueue, queueMsgConfig, syscall.AF_UNSPEC, 0, queueCommand(queueCmdPfUnbind, family))
+		if err != nil {
+			return fmt.Errorf("unbind family %d: %s", family, err)
+		}
+	}
+
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * OpenQueue binds to a queue and sets the copy range and maximum length.
+ */
+func OpenQueue(number uint16, copyRange uint32, maxlen uint32) (*Queue, error) {
+	sock, err := Open(0)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &Queue{sock: sock, number: number}
+
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		err = sock.Execute(subsysQueue, queueMsgConfig, syscall.AF_UNSPEC, 0, queueCommand(queueCmdPfBind, family))
+		if err != nil {
+			sock.Close()
+			return nil, fmt.Errorf("bind family %d: %s", family, err)
+		}
+	}
+
+	err = sock.Execute(subsysQueue, queueMsgConfig, syscall.AF_UNSPEC, number, queueCommand(queueCmdBind, 0))
+	if err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("bind queue %d: %s", number, err)
+	}
+
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params, copyRange)
+	params[4] = queueCopyPacket
+	attrs := AppendAttribute(nil, queueCfgParams, params)
+	attrs = AppendAttribute(attrs, queueCfgMaxlen, be32(maxlen))
+
+	err = sock.Execute(subsysQueue, queueMsgConfig, syscall.AF_UNSPEC, number, attrs)
+	if err != nil {
+		queue.Close()
+		return nil, fmt.Errorf("configure queue %d: %s", number, err)
+	}
+
+	return queue, nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * SetFailOpen makes the kernel accept packets instead of dropping them when
+ * the queue is full. It is not supported by older kernels.
+ */
+func (queue *Queue) SetFailOpen() error {
+	attrs := AppendAttribute(nil, queueCfgFlags, be32(queueFlagFailOpen))
+	attrs = AppendAttribute(attrs, queueCfgMask, be32(queueFlagFailOpen))
+	return queue.sock.Execute(subsysQueue, queueMsgConfig, syscall.AF_UNSPEC, queue.number, attrs)
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *Queue) SetReceiveBuffer(size int) error {
+	return queue.sock.SetReceiveBuffer(size)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Receive waits for the next datagram from the queue and returns the
+ * packets it holds. A full socket buffer is returned as syscall.ENOBUFS.
+ */
+func (queue *Queue) Receive(buffer []byte) ([]Packet, error) {
+	messages, err := queue.sock.Receive(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Packet
+
+	for _, message := range messages {
+		if (message.Subsys != subsysQueue) || (message.Type != queueMsgPacket) {
+			continue
+		}
+
+		var packet Packet
+		packet.Id = getBe32(message.Attrs, queueAttrPacketHdr)
+		packet.Mark = getBe32(message.Attrs, queueAttrMark)
+		packet.Payload = message.Attrs[queueAttrPayload]
+		list = append(list, packet)
+	}
+
+	return list, nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Verdict sets the verdict and mark for a packet and replaces the packet
+ * data when payload is not nil.
+ */
+func (queue *Queue) Verdict(id uint32, verdict uint32, mark uint32, payload []byte) error {
+	return queue.sock.Send(subsysQueue, queueMsgVerdict, 0, syscall.AF_UNSPEC, queue.number, buildVerdict(id, verdict, mark, payload))
+}
+
+/*---------------------------------------------------------------------------*/
+func buildVerdict(id uint32, verdict uint32, mark uint32, payload []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:], verdict)
+	binary.BigEndian.PutUint32(header[4:], id)
+
+	attrs := AppendAttribute(nil, queueAttrVerdictHdr, header)
+	attrs = AppendAttribute(attrs, queueAttrMark, be32(mark))
+	if payload != nil {
+		attrs = AppendAttribute(attrs, queueAttrPayload, payload)
+	}
+	return (attrs)
+}
+
+/*---------------------------------------------------------------------------*/
+func (queue *Queue) Close() error {
+	queue.sock.Send(subsysQueue, queueMsgConfig, 0, syscall.AF_UNSPEC, queue.number, queueCommand(queueCmdUnbind, 0))
+	return queue.sock.Close()
+}
+
+/*---------------------------------------------------------------------------*/
+func queueCommand(command uint8, family uint8) []byte {
+	value := make([]byte, 4)
+	value[0] = command
+	binary.BigEndian.PutUint16(value[2:], uint16(family))
+	return AppendAttribute(nil, queueCfgCmd, value)
+}
+
+/*---------------------------------------------------------------------------*/
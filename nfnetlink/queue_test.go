@@ -0,0 +1,53 @@
+package nfnetlink
+
+import "bytes"
+import "syscall"
+import "testing"
+import "encoding/binary"
+
+/*---------------------------------------------------------------------------*/
+func TestBuildVerdict(t *testing.T) {
+	attrs := ParseAttributes(buildVerdict(1234, VerdictRepeat, 0x10000000, nil))
+
+	header := attrs[queueAttrVerdictHdr]
+	if (len(header) != 8) || (binary.BigEndian.Uint32(header[0:]) != VerdictRepeat) || (binary.BigEndian.Uint32(header[4:]) != 1234) {
+		t.Errorf("the verdict header is %v", header)
+	}
+	if getBe32(attrs, queueAttrMark) != 0x10000000 {
+		t.Errorf("the mark is %v", attrs[queueAttrMark])
+	}
+	if _, ok := attrs[queueAttrPayload]; ok {
+		t.Errorf("a payload was sent without a rewritten packet")
+	}
+
+	payload := []byte{0x45, 0, 0, 20, 1, 2, 3}
+	attrs = ParseAttributes(buildVerdict(1, VerdictAccept, 0, payload))
+	if !bytes.Equal(attrs[queueAttrPayload], payload) {
+		t.Errorf("the payload is %v", attrs[queueAttrPayload])
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestQueueReceive(t *testing.T) {
+	payload := []byte{0x45, 0, 0, 20, 9, 8, 7, 6}
+
+	// the packet header has the id followed by the protocol and hook
+	header := []byte{0, 0, 0, 42, 0x08, 0x00, 3, 0}
+	attrs := AppendAttribute(nil, queueAttrPacketHdr, header)
+	attrs = AppendAttribute(attrs, queueAttrMark, be32(0x55))
+	attrs = AppendAttribute(attrs, queueAttrPayload, payload)
+
+	queue := &Queue{sock: &Socket{pending: [][]byte{
+		buildMessage(subsysQueue, queueMsgPacket, 0, 0, syscall.AF_INET, 2000, attrs),
+	}}}
+
+	list, err := queue.Receive(nil)
+	if (err != nil) || (len(list) != 1) {
+		t.Fatalf("Receive returned %v %v", list, err)
+	}
+	if (list[0].Id != 42) || (list[0].Mark != 0x55) || !bytes.Equal(list[0].Payload, payload) {
+		t.Errorf("the packet is %+v", list[0])
+	}
+}
+
+/*---------------------------------------------------------------------------*/
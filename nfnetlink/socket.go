@@ -0,0 +1,353 @@
+package nfnetlink
+
+import "fmt"
+import "time"
+import "unsafe"
+import "syscall"
+import "sync/atomic"
+import "encoding/binary"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Package nfnetlink talks to the netfilter queue, conntrack, and log
+ * subsystems over a netlink socket without the libnetfilter libraries.
+ * Every message starts with the netlink header followed by the nfgenmsg
+ * header and a list of attributes. The netlink and attribute headers are
+ * in host byte order and the netfilter attribute values are big endian.
+ */
+const netlinkNetfilter = 12
+
+const (
+	subsysCtnetlink = 1
+	subsysQueue     = 3
+	subsysUlog      = 4
+)
+
+const nfgenmsgLen = 4
+const attrHeaderLen = 4
+const attrNested = 0x8000
+const attrTypeMask = 0x3FFF
+
+// how long a receive waits so the caller can check for shutdown
+const receiveTimeout = time.Second
+
+var nativeEndian binary.ByteOrder
+
+/*---------------------------------------------------------------------------*/
+func init() {
+	value := uint16(1)
+	if *(*byte)(unsafe.Pointer(&value)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Socket is a netlink socket for the netfilter subsystems. Messages that
+ * arrive while we are waiting for the kernel to acknowledge a request are
+ * kept so they are still returned by the next Receive. Only Send may be
+ * called while another goroutine is using the socket.
+ */
+type Socket struct {
+	fd      int
+	seq     uint32
+	pending [][]byte
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Message is one netlink message with the nfgenmsg header decoded and the
+ * attributes indexed by type.
+ */
+type Message struct {
+	Subsys uint8
+	Type   uint8
+	Flags  uint16
+	Family uint8
+	ResId  uint16
+	Attrs  map[uint16][]byte
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Open creates a netlink socket for the netfilter subsystems that is a
+ * member of the multicast groups in the groups bit mask.
+ */
+func Open(groups uint32) (*Socket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %s", err)
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("bind: %s", err)
+	}
+
+	timeout := syscall.NsecToTimeval(receiveTimeout.Nanoseconds())
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("setsockopt(SO_RCVTIMEO): %s", err)
+	}
+
+	return &Socket{fd: fd}, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func (sock *Socket) Close() error {
+	return syscall.Close(sock.fd)
+}
+
+/*---------------------------------------------------------------------------*/
+func (sock *Socket) SetReceiveBuffer(size int) error {
+	return syscall.SetsockoptInt(sock.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Send sends a request without waiting for a reply.
+ */
+func (sock *Socket) Send(subsys uint8, msgType uint8, flags uint16, family uint8, resid uint16, attrs []byte) error {
+	seq := atomic.AddUint32(&sock.seq, 1)
+	message := buildMessage(subsys, msgType, syscall.NLM_F_REQUEST|flags, seq, family, resid, attrs)
+	return syscall.Sendto(sock.fd, message, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Execute sends a request and waits for the kernel to acknowledge it,
+ * returning the error from the kernel if the request failed.
+ */
+func (sock *Socket) Execute(subsys uint8, msgType uint8, family uint8, resid uint16, attrs []byte) error {
+	seq := atomic.AddUint32(&sock.seq, 1)
+	message := buildMessage(subsys, msgType, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, seq, family, resid, attrs)
+
+	err := syscall.Sendto(sock.fd, message, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	// big enough for any queued packet that arrives before the reply
+	buffer := make([]byte, 0x10000)
+
+	// give up if the kernel does not answer within a few receive timeouts
+	for retry := 0; retry < 5; {
+		size, _, err := syscall.Recvfrom(sock.fd, buffer, 0)
+		if (err == syscall.EAGAIN) || (err == syscall.EINTR) {
+			retry++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		list, err := syscall.ParseNetlinkMessage(buffer[:size])
+		if err != nil {
+			return err
+		}
+
+		var found, keep bool
+		var result error
+
+		for _, item := range list {
+			if (item.Header.Type != syscall.NLMSG_ERROR) || (item.Header.Seq != seq) {
+				keep = true
+				continue
+			}
+			found = true
+			if len(item.Data) < 4 {
+				result = fmt.Errorf("short netlink error message")
+			} else if errno := int32(nativeEndian.Uint32(item.Data)); errno != 0 {
+				result = syscall.Errno(-errno)
+			}
+		}
+
+		// anything else in the datagram is returned by the next Receive
+		if keep {
+			sock.pending = append(sock.pending, append([]byte(nil), buffer[:size]...))
+		}
+
+		if found {
+			return result
+		}
+	}
+
+	return fmt.Errorf("no reply from the kernel")
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Receive reads the next datagram into the buffer and returns the netfilter
+ * messages it contains, which point into the buffer. It returns nothing
+ * when the receive times out so the caller can check for shutdown.
+ */
+func (sock *Socket) Receive(buffer []byte) ([]Message, error) {
+	var data []byte
+
+	if len(sock.pending) != 0 {
+		data = sock.pending[0]
+		sock.pending = sock.pending[1:]
+	} else {
+		size, _, err := syscall.Recvfrom(sock.fd, buffer, 0)
+		if (err == syscall.EAGAIN) || (err == syscall.EINTR) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("the netlink socket was unexpectedly closed")
+		}
+		data = buffer[:size]
+	}
+
+	list, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(list))
+
+	for _, item := range list {
+		// skip the done, error, and other control messages
+		if (item.Header.Type < syscall.NLMSG_MIN_TYPE) || (len(item.Data) < nfgenmsgLen) {
+			continue
+		}
+
+		var message Message
+		message.Subsys = uint8(item.Header.Type >> 8)
+		message.Type = uint8(item.Header.Type)
+		message.Flags = item.Header.Flags
+		message.Family = item.Data[0]
+		message.ResId = binary.BigEndian.Uint16(item.Data[2:])
+		message.Attrs = ParseAttributes(item.Data[nfgenmsgLen:])
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func buildMessage(subsys uint8, msgType uint8, flags uint16, seq uint32, family uint8, resid uint16, attrs []byte) []byte {
+	length := syscall.NLMSG_HDRLEN + nfgenmsgLen + len(attrs)
+	message := make([]byte, length)
+
+	nativeEndian.PutUint32(message[0:], uint32(length))
+	nativeEndian.PutUint16(message[4:], (uint16(subsys)<<8)|uint16(msgType))
+	nativeEndian.PutUint16(message[6:], flags)
+	nativeEndian.PutUint32(message[8:], seq)
+	nativeEndian.PutUint32(message[12:], 0)
+
+	// the nfgenmsg header with the netfilter version and resource id
+	message[16] = family
+	message[17] = 0
+	binary.BigEndian.PutUint16(message[18:], resid)
+
+	copy(message[syscall.NLMSG_HDRLEN+nfgenmsgLen:], attrs)
+	return (message)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ParseAttributes returns the attributes in data indexed by type with the
+ * nested and byte order flags removed. The values point into data.
+ */
+func ParseAttributes(data []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+
+	for len(data) >= attrHeaderLen {
+		length := int(nativeEndian.Uint16(data[0:]))
+		kind := nativeEndian.Uint16(data[2:]) & attrTypeMask
+		if (length < attrHeaderLen) || (length > len(data)) {
+			break
+		}
+
+		attrs[kind] = data[attrHeaderLen:length]
+
+		aligned := attrAlign(length)
+		if aligned > len(data) {
+			break
+		}
+		data = data[aligned:]
+	}
+
+	return (attrs)
+}
+
+/*---------------------------------------------------------------------------*/
+func AppendAttribute(buffer []byte, kind uint16, value []byte) []byte {
+	header := make([]byte, attrHeaderLen)
+	nativeEndian.PutUint16(header[0:], uint16(attrHeaderLen+len(value)))
+	nativeEndian.PutUint16(header[2:], kind)
+
+	buffer = append(buffer, header...)
+	buffer = append(buffer, value...)
+
+	for len(buffer)%4 != 0 {
+		buffer = append(buffer, 0)
+	}
+
+	return (buffer)
+}
+
+/*---------------------------------------------------------------------------*/
+func appendNested(buffer []byte, kind uint16, value []byte) []byte {
+	return AppendAttribute(buffer, kind|attrNested, value)
+}
+
+/*---------------------------------------------------------------------------*/
+func attrAlign(length int) int {
+	return ((length + 3) &^ 3)
+}
+
+/*---------------------------------------------------------------------------*/
+func be16(value uint16) []byte {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return (data)
+}
+
+/*---------------------------------------------------------------------------*/
+func be32(value uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return (data)
+}
+
+/*---------------------------------------------------------------------------*/
+func getBe16(attrs map[uint16][]byte, kind uint16) uint16 {
+	if value := attrs[kind]; len(value) >= 2 {
+		return binary.BigEndian.Uint16(value)
+	}
+	return (0)
+}
+
+/*---------------------------------------------------------------------------*/
+func getBe32(attrs map[uint16][]byte, kind uint16) uint32 {
+	if value := attrs[kind]; len(value) >= 4 {
+		return binary.BigEndian.Uint32(value)
+	}
+	return (0)
+}
+
+/*---------------------------------------------------------------------------*/
+func getBe64(attrs map[uint16][]byte, kind uint16) uint64 {
+	if value := attrs[kind]; len(value) >= 8 {
+		return binary.BigEndian.Uint64(value)
+	}
+	return (0)
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,67 @@
+package nfnetlink
+
+import "bytes"
+import "syscall"
+import "testing"
+
+/*---------------------------------------------------------------------------*/
+func TestParseAttributes(t *testing.T) {
+	attrs := AppendAttribute(nil, 1, []byte{0xAA})
+	attrs = appendNested(attrs, 2, AppendAttribute(nil, 3, be32(0x01020304)))
+	attrs = AppendAttribute(attrs, 4, nil)
+
+	// every attribute is padded to a multiple of four bytes
+	if len(attrs) != 8+12+4 {
+		t.Fatalf("attributes are %d bytes", len(attrs))
+	}
+
+	parsed := ParseAttributes(attrs)
+	if !bytes.Equal(parsed[1], []byte{0xAA}) {
+		t.Errorf("attribute 1 is %v", parsed[1])
+	}
+	if getBe32(ParseAttributes(parsed[2]), 3) != 0x01020304 {
+		t.Errorf("the nested attribute was not found without the nested flag")
+	}
+	if value, ok := parsed[4]; !ok || (len(value) != 0) {
+		t.Errorf("the empty attribute is %v %v", value, ok)
+	}
+
+	// a truncated attribute is ignored along with anything after it
+	parsed = ParseAttributes(attrs[:len(attrs)-13])
+	if _, ok := parsed[2]; ok || (len(parsed) != 1) {
+		t.Errorf("the truncated attributes are %v", parsed)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestBuildMessage(t *testing.T) {
+	attrs := AppendAttribute(nil, 1, be16(0x1234))
+	data := buildMessage(subsysQueue, queueMsgConfig, syscall.NLM_F_ACK, 77, syscall.AF_INET, 2000, attrs)
+
+	list, err := syscall.ParseNetlinkMessage(data)
+	if (err != nil) || (len(list) != 1) {
+		t.Fatalf("the message did not parse: %v", err)
+	}
+
+	header := list[0].Header
+	if (header.Type != (subsysQueue<<8)|queueMsgConfig) || (header.Flags != syscall.NLM_F_ACK) || (header.Seq != 77) || (int(header.Len) != len(data)) {
+		t.Errorf("the netlink header is %+v", header)
+	}
+
+	// the messages kept while waiting for an ack are returned by Receive
+	sock := &Socket{pending: [][]byte{data}}
+	messages, err := sock.Receive(nil)
+	if (err != nil) || (len(messages) != 1) {
+		t.Fatalf("Receive returned %v %v", messages, err)
+	}
+
+	message := messages[0]
+	if (message.Subsys != subsysQueue) || (message.Type != queueMsgConfig) || (message.Family != syscall.AF_INET) || (message.ResId != 2000) {
+		t.Errorf("the message is %+v", message)
+	}
+	if getBe16(message.Attrs, 1) != 0x1234 {
+		t.Errorf("the attribute is %v", message.Attrs[1])
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,195 @@
+package main
+
+import "os"
+import "fmt"
+import "time"
+import "bufio"
+import "strings"
+import "strconv"
+import "sync/atomic"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The queues are opened with NFQA_CFG_F_FAIL_OPEN so the kernel accepts
+ * packets rather than dropping them when a queue is full. We also watch the
+ * queue backlog and the kernel drop counters, along with ENOBUFS errors
+ * from the receive loop, and when we fall behind we switch to a degraded
+ * mode that skips the plugin handlers until things have been quiet for the
+ * hold time. In accept mode packets are simply accepted, and in bypass mode
+ * we also set the bypass mark so the session stops using the queue.
+ */
+const (
+	overloadNone = iota
+	overloadAccept
+	overloadBypass
+)
+
+const queueStatusFile = "/proc/net/netfilter/nfnetlink_queue"
+
+var overloadMode int
+var overloadThreshold int
+var overloadHold time.Duration
+
+var degraded int32
+var degradedSince int64
+var degradedPackets uint64
+var overloadTrigger int64
+
+/*---------------------------------------------------------------------------*/
+func parseOverloadMode(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return overloadNone, nil
+	case "accept":
+		return overloadAccept, nil
+	case "bypass":
+		return overloadBypass, nil
+	}
+	return overloadNone, fmt.Errorf("invalid overload mode: %s", name)
+}
+
+/*---------------------------------------------------------------------------*/
+func overloadModeName(mode int) string {
+	switch mode {
+	case overloadAccept:
+		return ("accept")
+	case overloadBypass:
+		return ("bypass")
+	}
+	return ("none")
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * overloadEnter is called whenever we see that we are falling behind. The
+ * time is always saved so the hold time starts again, and unless the mode
+ * is none we switch to degraded mode if we are not there already.
+ */
+func overloadEnter(reason string) {
+	atomic.StoreInt64(&overloadTrigger, time.Now().UnixNano())
+
+	if overloadMode == overloadNone {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&degraded, 0, 1) {
+		atomic.StoreInt64(&degradedSince, time.Now().UnixNano())
+		support.IncrementCounter("netfilter.degraded")
+		support.LogMessage("Entering degraded %s mode: %s\n", overloadModeName(overloadMode), reason)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * overloadVerdict is used by netfilterHandler for every packet while
+ * we are in degraded mode. It returns the new mark for the packet and true
+ * if the packet should be repeated so the bypass mark is saved.
+ */
+func overloadVerdict(mark uint32) (uint32, bool) {
+	atomic.AddUint64(&degradedPackets, 1)
+
+	if overloadMode == overloadBypass {
+		return (mark | support.BypassMark), ((mark & support.BypassMark) == 0)
+	}
+
+	return mark, false
+}
+
+/*---------------------------------------------------------------------------*/
+func overloadMonitor(config support.QueueConfig) {
+	previous := make(map[int]support.QueueStatus)
+	support.SetOverloadStatus(support.OverloadStatus{Mode: overloadModeName(overloadMode)})
+
+	for {
+		time.Sleep(time.Second)
+
+		support.AddCounter("netfilter.degraded_packets", atomic.SwapUint64(&degradedPackets, 0))
+
+		list := readQueueStatus(config)
+
+		for _, item := range list {
+			last := previous[item.Queue]
+			previous[item.Queue] = item
+
+			if item.QueueDropped > last.QueueDropped {
+				support.AddCounter("netfilter.queue_dropped", item.QueueDropped-last.QueueDropped)
+				overloadEnter(fmt.Sprintf("queue %d dropped packets", item.Queue))
+			}
+
+			if item.UserDropped > last.UserDropped {
+				support.AddCounter("netfilter.user_dropped", item.UserDropped-last.UserDropped)
+				overloadEnter(fmt.Sprintf("queue %d could not deliver packets", item.Queue))
+			}
+
+			if item.Backlog >= config.QueueMaxlen {
+				support.IncrementCounter("netfilter.queue_full")
+			}
+
+			if (item.Backlog * 100) >= (config.QueueMaxlen * overloadThreshold) {
+				overloadEnter(fmt.Sprintf("queue %d backlog %d", item.Queue, item.Backlog))
+			}
+		}
+
+		// leave degraded mode once nothing has triggered it for the hold time
+		if atomic.LoadInt32(&degraded) != 0 {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&overloadTrigger))) >= overloadHold {
+				atomic.StoreInt32(&degraded, 0)
+				support.LogMessage("Leaving degraded %s mode\n", overloadModeName(overloadMode))
+			}
+		}
+
+		var status support.OverloadStatus
+		status.Mode = overloadModeName(overloadMode)
+		status.Queues = list
+		if atomic.LoadInt32(&degraded) != 0 {
+			status.Degraded = true
+			status.DegradedSince = time.Unix(0, atomic.LoadInt64(&degradedSince))
+		}
+		support.SetOverloadStatus(status)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * readQueueStatus returns the kernel status for each of our queues. Each line
+ * of the file has the queue number, the owner, the backlog, the copy mode,
+ * the copy range, the queue and user drop counts, and the next packet id.
+ */
+func readQueueStatus(config support.QueueConfig) []support.QueueStatus {
+	var list []support.QueueStatus
+
+	file, err := os.Open(queueStatusFile)
+	if err != nil {
+		return (list)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+
+		queue, err := strconv.Atoi(fields[0])
+		if (err != nil) || (queue < config.QueueFirst) || (queue >= (config.QueueFirst + config.QueueCount)) {
+			continue
+		}
+
+		var item support.QueueStatus
+		item.Queue = queue
+		item.Backlog, _ = strconv.Atoi(fields[2])
+		item.QueueDropped, _ = strconv.ParseUint(fields[5], 10, 64)
+		item.UserDropped, _ = strconv.ParseUint(fields[6], 10, 64)
+		list = append(list, item)
+	}
+
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
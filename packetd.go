@@ -1,19 +1,14 @@
 package main
 
-//#include "common.h"
-//#include "netfilter.h"
-//#include "conntrack.h"
-//#include "netlogger.h"
-//#cgo LDFLAGS: -lnetfilter_queue -lnfnetlink -lnetfilter_conntrack -lnetfilter_log
-import "C"
-
 import "os"
-import "net"
+import "flag"
+import "runtime"
 import "time"
 import "sync"
 import "bufio"
-import "unsafe"
-import "encoding/binary"
+import "strings"
+import "strconv"
+import "sync/atomic"
 import "github.com/google/gopacket"
 import "github.com/google/gopacket/layers"
 import "github.com/untangle/packetd/support"
@@ -28,38 +23,154 @@ import "github.com/untangle/packetd/restd"
 /*
  * The childsync is used to give the main process something to watch while
  * waiting for all of the goroutine children to finish execution and cleanup.
- * To give C child functions access we export go_child_startup and goodbye
- * functions. For children in normal go packages, we pass the WaitGroup
- * directly to the goroutine.
+ * The kernel sources are added by runSource, and the plugins are added by
+ * the support package while they are running.
  */
 var childsync sync.WaitGroup
 
+// update events are frequent so they are only received when asked for
+var conntrackUpdates bool
+
 /*---------------------------------------------------------------------------*/
 func main() {
 	var lastmin int
 	var counter int
+	var defaultAction string
+	var overloadName string
+	var replayFile string
+	var backendName string
+	var kernel kernelBackend
+	var replayDone chan bool
+	var workers int
+	var queue support.QueueConfig
+	var verdict support.Verdict
+	var err error
+
+	flag.DurationVar(&handlerTimeout, "handler-timeout", 100*time.Millisecond, "maximum time to wait for each plugin netfilter handler")
+	flag.IntVar(&workers, "workers", runtime.NumCPU()*2, "number of netfilter dispatch worker goroutines")
+	flag.IntVar(&queue.QueueFirst, "queue", 1818, "number of the first netfilter queue")
+	flag.IntVar(&queue.QueueCount, "queue-count", runtime.NumCPU(), "number of netfilter queues starting with -queue")
+	flag.IntVar(&queue.SockBuffer, "sock-buffer", 1048576, "netfilter socket receive buffer size or zero for the system default")
+	flag.IntVar(&queue.QueueMaxlen, "queue-maxlen", 10240, "maximum number of packets waiting in each netfilter queue")
+	flag.IntVar(&queue.NetBuffer, "net-buffer", 32768, "netfilter receive buffer size and packet copy range")
+	flag.StringVar(&defaultAction, "default-verdict", "accept", "verdict used when a plugin netfilter handler times out or fails")
+	flag.StringVar(&backendName, "backend", defaultBackend, "how packets and events are received from the kernel: "+strings.Join(backendNames(), ", "))
+	flag.StringVar(&replayFile, "replay", "", "read packets from a pcap or pcapng file instead of the netfilter queues")
+	flag.StringVar(&overloadName, "overload-mode", "accept", "what to do with packets when the queues fall behind: none, accept, or bypass")
+	flag.IntVar(&overloadThreshold, "overload-threshold", 80, "queue backlog as a percent of -queue-maxlen that starts the overload mode")
+	flag.DurationVar(&overloadHold, "overload-hold", 10*time.Second, "how long the overload mode lasts after the last overload event")
+	flag.BoolVar(&conntrackUpdates, "conntrack-updates", false, "also receive conntrack update events along with new and destroy")
+	flag.IntVar(&streamConnPages, "stream-conn-pages", 64, "maximum out of order pages buffered for each reassembled TCP stream")
+	flag.IntVar(&streamTotalPages, "stream-total-pages", 4096, "maximum out of order pages buffered for all reassembled TCP streams")
+	flag.Parse()
 
 	support.Startup()
-	C.common_startup()
 
 	support.LogMessage("Untangle Packet Daemon Version %s\n", "1.00")
 
-	go C.netfilter_thread()
-	go C.conntrack_thread()
-	go C.netlogger_thread()
+	verdict.Action, err = support.ParseVerdictAction(defaultAction)
+	if err != nil {
+		support.LogMessage("Error parsing -default-verdict: %s\n", err)
+		os.Exit(1)
+	}
+	support.SetDefaultVerdict(verdict)
+
+	overloadMode, err = parseOverloadMode(overloadName)
+	if err != nil {
+		support.LogMessage("Error parsing -overload-mode: %s\n", err)
+		os.Exit(1)
+	}
+
+	if (overloadThreshold < 1) || (overloadThreshold > 100) {
+		support.LogMessage("Error -overload-threshold must be between 1 and 100\n")
+		os.Exit(1)
+	}
+
+	if (streamConnPages < 1) || (streamTotalPages < streamConnPages) {
+		support.LogMessage("Error -stream-conn-pages must be at least 1 and no more than -stream-total-pages\n")
+		os.Exit(1)
+	}
+
+	// the replay input takes the place of the kernel sources
+	if replayFile == "" {
+		kernel, err = createBackend(backendName)
+		if err != nil {
+			support.LogMessage("Error parsing -backend: %s\n", err)
+			os.Exit(1)
+		}
+		support.LogMessage("Using the %s kernel backend\n", backendName)
+	}
+
+	// values in the settings file are used for any flags not given
+	applyQueueSettings()
+
+	err = queue.Validate()
+	if err != nil {
+		support.LogMessage("Error in netfilter queue configuration: %s\n", err)
+		os.Exit(1)
+	}
+	support.SetQueueConfig(queue)
 
-	// ********** Call all plugin startup functions here
+	// ********** Register all plugins here
 
-	go example.Plugin_Startup(&childsync)
-	go classify.Plugin_Startup(&childsync)
-	go geoip.Plugin_Startup(&childsync)
-	go certcache.Plugin_Startup(&childsync)
+	support.RegisterPlugin(&example.Plugin{})
+	support.RegisterPlugin(&classify.Plugin{})
+	support.RegisterPlugin(&geoip.Plugin{})
+	support.RegisterPlugin(&certcache.Plugin{})
+
+	// ********** End of plugin registration
+
+	// start every plugin enabled in the settings file before we start
+	// receiving traffic so mark field conflicts are detected and logged first
+	support.StartPlugins(&childsync)
+
+	// start the workers that call the plugin netfilter handlers
+	dispatchStartup(workers)
+
+	// start the TCP stream assembler and the workers for the stream handlers
+	streamStartup(runtime.NumCPU())
+
+	if replayFile != "" {
+		// read packets from the replay file instead of the kernel
+		replayDone = make(chan bool)
+		bufferStartup(1)
+		go replayCapture(replayFile, replayDone)
+	} else {
+		// start a netfilter thread for every queue
+		err = kernel.queue.Configure(queue)
+		if err != nil {
+			support.LogMessage("Error configuring the netfilter queues: %s\n", err)
+			os.Exit(1)
+		}
+		bufferStartup(queue.QueueCount)
+		for i := 0; i < queue.QueueCount; i++ {
+			index := i
+			runSource("netfilter", func() error { return kernel.queue.Run(index) })
+		}
+		go overloadMonitor(queue)
+
+		// tell update_rules which queues to send traffic to
+		err = support.WriteQueueState()
+		if err != nil {
+			support.LogMessage("Error writing the netfilter queue state: %s\n", err)
+		}
+
+		err = kernel.conntrack.Configure(conntrackUpdates)
+		if err != nil {
+			support.LogMessage("Error configuring conntrack: %s\n", err)
+			os.Exit(1)
+		}
+		runSource("conntrack", kernel.conntrack.Run)
+
+		// let plugins and the REST API change and kill sessions through conntrack
+		support.SetConntrackControl(kernel.conntrack)
+
+		runSource("netlogger", kernel.logger.Run)
+	}
 
 	// Start REST HTTP daemon
 	go restd.StartRestDaemon()
 
-	// ********** End of plugin startup functions
-
 	ch := make(chan string)
 	go func(ch chan string) {
 		reader := bufio.NewReader(os.Stdin)
@@ -78,221 +189,352 @@ func main() {
 
 stdinloop:
 	for {
-		shutdown := C.get_shutdown_flag()
-		if shutdown != 0 {
+		if getShutdownFlag() {
 			break
 		}
 		select {
 		case stdin, ok := <-ch:
-			if !ok {
+			if !ok && (replayDone != nil) {
+				// keep going without a console until the replay is finished
+				ch = nil
+			} else if !ok {
 				break stdinloop
 			} else {
 				support.LogMessage("Console input detected - Application shutting down\n")
 				_ = stdin
 				break stdinloop
 			}
+		case <-replayDone:
+			support.LogMessage("Replay finished - Application shutting down\n")
+			for name, value := range support.GetCounters() {
+				support.LogMessage("COUNTER %s = %d\n", name, value)
+			}
+			break stdinloop
 		case <-time.After(1 * time.Second):
 			current := time.Now()
 			if current.Minute() != lastmin {
 				lastmin = current.Minute()
 				counter++
-				support.LogMessage("Calling perodic conntrack dump %d\n", counter)
-				C.conntrack_dump()
+				if kernel.conntrack != nil {
+					support.LogMessage("Calling perodic conntrack dump %d\n", counter)
+					kernel.conntrack.Dump()
+				}
+				support.CleanSessionTable()
 				support.CleanConntrackTable()
 				support.CleanCertificateTable()
+				support.CleanBlockTable()
 			}
 		}
 	}
 
-	// ********** Call all plugin goodbye functions here
-
-	go example.Plugin_Goodbye(&childsync)
-	go classify.Plugin_Goodbye(&childsync)
-	go geoip.Plugin_Goodbye(&childsync)
-	go certcache.Plugin_Goodbye(&childsync)
+	// deliver any buffered stream data before the plugins are stopped
+	streamGoodbye()
 
-	// ********** End of plugin goodbye functions
+	// call the goodbye function for every running plugin
+	support.StopPlugins()
 
-	C.netfilter_goodbye()
-	C.conntrack_goodbye()
-	C.netlogger_goodbye()
+	setShutdownFlag()
+	if replayFile == "" {
+		support.RemoveQueueState()
+		kernel.queue.Shutdown()
+		kernel.conntrack.Shutdown()
+		kernel.logger.Shutdown()
+	}
 	childsync.Wait()
 }
 
 /*---------------------------------------------------------------------------*/
-//export go_netfilter_callback
-func go_netfilter_callback(mark C.int, data *C.uchar, size C.int) int32 {
 
-	// ***** this version creates a Go copy of the buffer = SLOWER
-	// buffer := C.GoBytes(unsafe.Pointer(data),size)
+/*
+ * The netfilter section of the settings file uses the flag names with
+ * underscores, so queue_count sets the same value as -queue-count. Flags
+ * given on the command line take precedence over the settings file.
+ */
+func applyQueueSettings() {
+	explicit := make(map[string]bool)
+	flag.Visit(func(item *flag.Flag) { explicit[item.Name] = true })
+
+	for name, value := range support.ReadQueueSettings() {
+		flagname := strings.Replace(name, "_", "-", -1)
+		if explicit[flagname] {
+			continue
+		}
+
+		switch flagname {
+		case "queue", "queue-count", "sock-buffer", "queue-maxlen", "net-buffer":
+			flag.Set(flagname, strconv.Itoa(value))
+		default:
+			support.LogMessage("Ignoring unknown netfilter setting %s\n", name)
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * netfilterHandler does all of the work for a packet from a netfilter queue
+ * or the replay input. It returns the verdict and the decoded packet, which
+ * is nil if the packet was not passed to the plugins. The buffer must stay
+ * valid until every handler has finished with it.
+ */
+func netfilterHandler(queue int, mark uint32, buffer []byte) (support.Verdict, gopacket.Packet) {
+	// start with the existing mark on the packet and a default accept
+	var verdict support.Verdict
+	verdict.Action = support.VerdictAccept
+	verdict.Mark = mark
+
+	// when the queues are overloaded we skip the plugins entirely
+	if atomic.LoadInt32(&degraded) != 0 {
+		var repeat bool
+		verdict.Mark, repeat = overloadVerdict(mark)
+		if repeat {
+			verdict.Action = support.VerdictRepeat
+		}
+		return verdict, nil
+	}
 
-	// ***** this version creates a Go pointer to the buffer = FASTER
-	buffer := (*[0xFFFF]byte)(unsafe.Pointer(data))[:int(size):int(size)]
+	var decoded gopacket.Packet
+	var ipv4Layer *layers.IPv4
+	var ipv6Layer *layers.IPv6
 
-	// convert the C integer to a Go integer
-	length := int(size)
+	options := gopacket.DecodeOptions{Lazy: true, NoCopy: true}
 
-	// get the existing mark on the packet
-	var pmark int32 = int32(C.int(mark))
+	if len(buffer) == 0 {
+		return verdict, nil
+	}
 
-	// make a gopacket from the raw packet data
-	packet := gopacket.NewPacket(buffer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	// make a gopacket from the raw packet data based on the IP version
+	switch buffer[0] >> 4 {
+	case 4:
+		decoded = gopacket.NewPacket(buffer, layers.LayerTypeIPv4, options)
+		if ipLayer := decoded.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+			ipv4Layer = ipLayer.(*layers.IPv4)
+		}
+	case 6:
+		decoded = gopacket.NewPacket(buffer, layers.LayerTypeIPv6, options)
+		if ipLayer := decoded.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+			ipv6Layer = ipLayer.(*layers.IPv6)
+		}
+	}
 
-	// get the  IPv4 layer
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		return (pmark)
+	if (ipv4Layer == nil) && (ipv6Layer == nil) {
+		return verdict, nil
 	}
-	ip := ipLayer.(*layers.IPv4)
 
+	handlers := support.GetNetfilterPlugins()
+
+	// the context holds the decoded packet for all of the plugin handlers
+	packet := acquirePacket(queue, len(handlers))
+	defer packet.release()
+
+	ctx := &packet.ctx
+	ctx.Buffer = buffer
+	ctx.Length = len(buffer)
+	ctx.Packet = decoded
+	ctx.IPv4Layer = ipv4Layer
+	ctx.IPv6Layer = ipv6Layer
+
+	// the packet tuple has the packet source as the client
 	var tuple support.Tuple
-	tuple.Protocol = uint8(ip.Protocol)
-	tuple.ClientAddr = ip.SrcIP
-	tuple.ServerAddr = ip.DstIP
+
+	if ipv4Layer != nil {
+		tuple.ClientAddr = ipv4Layer.SrcIP
+		tuple.ServerAddr = ipv4Layer.DstIP
+	} else {
+		tuple.ClientAddr = ipv6Layer.SrcIP
+		tuple.ServerAddr = ipv6Layer.DstIP
+	}
+
+	// the protocol comes from the TCP or UDP layer since IPv6 extension
+	// headers mean the IPv6 next header is not always the transport protocol
 
 	// get the TCP layer
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	tcpLayer := decoded.Layer(layers.LayerTypeTCP)
 	if tcpLayer != nil {
-		tcp := tcpLayer.(*layers.TCP)
-		tuple.ClientPort = uint16(tcp.SrcPort)
-		tuple.ServerPort = uint16(tcp.DstPort)
+		ctx.TCPLayer = tcpLayer.(*layers.TCP)
+		tuple.Protocol = uint8(layers.IPProtocolTCP)
+		tuple.ClientPort = uint16(ctx.TCPLayer.SrcPort)
+		tuple.ServerPort = uint16(ctx.TCPLayer.DstPort)
 	}
 
 	// get the UDP layer
-	udpLayer := packet.Layer(layers.LayerTypeUDP)
+	udpLayer := decoded.Layer(layers.LayerTypeUDP)
 	if udpLayer != nil {
-		udp := udpLayer.(*layers.UDP)
-		tuple.ClientPort = uint16(udp.SrcPort)
-		tuple.ServerPort = uint16(udp.DstPort)
+		ctx.UDPLayer = udpLayer.(*layers.UDP)
+		tuple.Protocol = uint8(layers.IPProtocolUDP)
+		tuple.ClientPort = uint16(ctx.UDPLayer.SrcPort)
+		tuple.ServerPort = uint16(ctx.UDPLayer.DstPort)
 	}
 
 	// right now we only care about TCP and UDP
 	if (tcpLayer == nil) && (udpLayer == nil) {
-		return (pmark)
+		return verdict, nil
 	}
 
-	var entry support.SessionEntry
-	var ok bool
+	// drop packets for a session that was killed until its block expires
+	if support.IsBlocked(tuple) {
+		support.IncrementCounter("netfilter.blocked")
+		verdict.Action = support.VerdictDrop
+		return verdict, nil
+	}
 
-	finder := support.Tuple2String(tuple)
+	var ok bool
 
 	/*
-	 * If we already have a session entry update the existing, otherwise
-	 * create a new entry for the table.
+	 * Look for the session in both directions so reply packets join the
+	 * session created by the original packet. Conntrack creates the session
+	 * for connections it already has, including those that were open when
+	 * we started, so a new session normally starts with a client packet.
 	 */
-	if entry, ok = support.FindSessionEntry(finder); ok {
+	ctx.Session, ok = support.FindOrCreateSession(tuple)
+
+	finder := support.Tuple2String(ctx.Session.SessionTuple)
+
+	if ok {
 		support.LogMessage("SESSION Found %s in table\n", finder)
-		entry.UpdateCount++
 	} else {
 		support.LogMessage("SESSION Adding %s to table\n", finder)
-		entry.SessionId = support.NextSessionId()
-		entry.SessionCreation = time.Now()
-		entry.UpdateCount = 1
 	}
 
-	// TODO - pass the gopacket to the handlers instead of the raw buffer
+	ctx.Tuple = ctx.Session.SessionTuple
+	ctx.ClientToServer = ctx.Session.SessionTuple.ClientAddr.Equal(tuple.ClientAddr) && (ctx.Session.SessionTuple.ClientPort == tuple.ClientPort)
 
-	// ********** Call all plugin netfilter handler functions here
+	atomic.AddUint64(&ctx.Session.UpdateCount, 1)
+	if ctx.ClientToServer {
+		atomic.AddUint64(&ctx.Session.C2Spackets, 1)
+		atomic.AddUint64(&ctx.Session.C2Sbytes, uint64(len(buffer)))
+	} else {
+		atomic.AddUint64(&ctx.Session.S2Cpackets, 1)
+		atomic.AddUint64(&ctx.Session.S2Cbytes, uint64(len(buffer)))
+	}
 
-	c1 := make(chan int32)
-	go example.Plugin_netfilter_handler(c1, buffer, length)
-	c2 := make(chan int32)
-	go classify.Plugin_netfilter_handler(c2, buffer, length)
-	c3 := make(chan int32)
-	go geoip.Plugin_netfilter_handler(c3, buffer, length)
-	c4 := make(chan int32)
-	go certcache.Plugin_netfilter_handler(c4, tuple)
+	ctx.Session.SetActivity(time.Now())
 
-	// ********** End of plugin netfilter callback functions
+	// call the netfilter handler for every plugin subscribed to the session
+	dispatchHandlers(packet, handlers)
 
-	// add the mark bits returned from each package handler
-	for i := 0; i < 2; i++ {
-		select {
-		case mark1 := <-c1:
-			pmark |= mark1
-		case mark2 := <-c2:
-			pmark |= mark2
-		case mark3 := <-c3:
-			pmark |= mark3
+	// combine the verdicts in plugin registration order so the result
+	// does not depend on which handler happened to finish first
+	for i, result := range packet.results {
+		// only apply the mark bits within the fields owned by the plugin
+		allowed := support.GetOwnerMask(handlers[i].Name())
+		if (result.Mask &^ allowed) != 0 {
+			support.IncrementCounter("plugin." + handlers[i].Name() + ".badmark")
+			result.Mask &= allowed
+		}
+
+		if (result.Packet != nil) && (verdict.Packet != nil) {
+			support.IncrementCounter("plugin." + handlers[i].Name() + ".rewrite_conflict")
+		}
+
+		verdict = support.MergeVerdict(verdict, result)
+		if result.Release {
+			ctx.Session.Release(handlers[i].Name())
+		}
+	}
+
+	/*
+	 * When every plugin has released the session we set the bypass bit and
+	 * repeat the packet so the rules installed by update_rules can save the
+	 * bit in the connmark, after which the session skips the queue. If the
+	 * packet already has the bit we just accept to avoid a repeat loop.
+	 */
+	if (ctx.Session.SubscriptionCount() == 0) && (ctx.Session.StreamCount() == 0) {
+		if (verdict.Action == support.VerdictAccept) && ((mark & support.BypassMark) == 0) {
+			verdict.Action = support.VerdictRepeat
 		}
+		verdict.Mark |= support.BypassMark
+	}
+
+	// pass accepted TCP packets to the stream assembler since the others
+	// will not reach the other side or will be back again
+	if (verdict.Action == support.VerdictAccept) && (ctx.TCPLayer != nil) {
+		streamPacket(ctx.Session, decoded.NetworkLayer(), ctx.TCPLayer)
 	}
 
-	// return the updated mark to be set on the packet
-	return (pmark)
+	// copy the packet to any capture armed for the session
+	support.CapturePacket(ctx.Session.SessionId, ctx.Tuple, buffer, verdict.Action)
+
+	return verdict, decoded
 }
 
 /*---------------------------------------------------------------------------*/
-//export go_conntrack_callback
-func go_conntrack_callback(info *C.struct_conntrack_info) {
-	var tuple support.Tuple
-	var entry support.ConntrackEntry
 
+/*
+ * conntrackHandler updates the conntrack table and calls the plugins for
+ * an event from conntrack or the replay input.
+ */
+func conntrackHandler(info *conntrackInfo) {
+	var entry support.ConntrackEntry
 	var ok bool
 
-	tuple.Protocol = uint8(info.orig_proto)
+	message := info.message
+	current := time.Now()
+	finder := support.Tuple2String(info.tuple)
+	packet := packetTuple(info.tuple, info.replyTuple)
 
-	tuple.ClientAddr = make(net.IP, 4)
-	binary.LittleEndian.PutUint32(tuple.ClientAddr, uint32(info.orig_saddr))
-	tuple.ClientPort = uint16(info.orig_sport)
-
-	tuple.ServerAddr = make(net.IP, 4)
-	binary.LittleEndian.PutUint32(tuple.ServerAddr, uint32(info.orig_daddr))
-	tuple.ServerPort = uint16(info.orig_dport)
+	/*
+	 * Conntrack can reuse a tuple once the old connection is gone. We see
+	 * this as a new event for an entry we already have, an event for an
+	 * entry that was destroyed, or byte counts that went down, and in all
+	 * of these cases the old entry is replaced. Events without counters
+	 * say nothing about the byte counts.
+	 */
+	if entry, ok = support.FindConntrackEntry(finder); ok {
+		if (message == 'N') || (entry.PurgeFlag && (message != 'D')) || (info.counters && !entry.UpdateCounters(info.origBytes, info.replBytes, current)) {
+			support.LogMessage("CONNTRACK Replacing %s in table\n", finder)
+			support.IncrementCounter("conntrack.reused")
+			support.RemoveSessionId(entry.SessionId, info.tuple, packetTuple(entry.SessionTuple, entry.ReplyTuple))
+			ok = false
+		}
+	}
 
-	finder := support.Tuple2String(tuple)
+	/*
+	 * The packets and the conntrack events for a flow share one session,
+	 * created by whichever sees the flow first, so the conntrack entry has
+	 * the same session ID as the packets. The packets have the tuple after
+	 * DNAT so we look for the session with that tuple too.
+	 */
+	session, _ := support.FindOrCreateNatSession(info.tuple, packet)
+	session.SetActivity(current)
 
 	/*
 	 * If we already have a conntrack entry update the existing, otherwise
 	 * create a new entry for the table.
 	 */
-	if entry, ok = support.FindConntrackEntry(finder); ok {
+	if ok {
 		support.LogMessage("CONNTRACK Found %s in table\n", finder)
 		entry.UpdateCount++
 	} else {
 		support.LogMessage("CONNTRACK Adding %s to table\n", finder)
-		entry.SessionId = support.NextSessionId()
-		entry.SessionCreation = time.Now()
-		entry.SessionTuple = tuple
+		entry = support.ConntrackEntry{}
+		entry.SessionId = session.SessionId
+		entry.SessionCreation = current
+		entry.SessionTuple = info.tuple
 		entry.UpdateCount = 1
+		if info.counters {
+			entry.UpdateCounters(info.origBytes, info.replBytes, current)
+		}
+	}
+
+	// keep the reply tuple we already have if the source does not know it
+	if info.replyTuple.ClientAddr != nil {
+		entry.ReplyTuple = info.replyTuple
 	}
 
-	oldC2sBytes := entry.C2Sbytes
-	oldS2cBytes := entry.S2Cbytes
-	oldTotalBytes := entry.TotalBytes
-	newC2sBytes := uint64(info.orig_bytes)
-	newS2cBytes := uint64(info.repl_bytes)
-	newTotalBytes := (newC2sBytes + newS2cBytes)
-	diffC2sBytes := (newC2sBytes - oldC2sBytes)
-	diffS2cBytes := (newS2cBytes - oldS2cBytes)
-	diffTotalBytes := (newTotalBytes - oldTotalBytes)
-
-	// In some cases, specifically UDP, a new session takes the place of an old session with the same tuple.
-	// In this case the counts go down because its actually a new session. If the total bytes is low, this
-	// is probably the case so treat it as a new entry.
-	if (diffC2sBytes < 0) || (diffS2cBytes < 0) {
-		newC2sBytes = uint64(info.orig_bytes)
-		diffC2sBytes = newC2sBytes
-		newS2cBytes = uint64(info.repl_bytes)
-		diffS2cBytes = newS2cBytes
-		newTotalBytes = (newC2sBytes + newS2cBytes)
-		diffTotalBytes = newTotalBytes
-		return
-	}
-
-	c2sRate := float32(diffC2sBytes / 60)
-	s2cRate := float32(diffS2cBytes / 60)
-	totalRate := float32(diffTotalBytes / 60)
-
-	entry.C2Sbytes = newC2sBytes
-	entry.S2Cbytes = newS2cBytes
-	entry.TotalBytes = newTotalBytes
-	entry.C2Srate = c2sRate
-	entry.S2Crate = s2cRate
-	entry.TotalRate = totalRate
-
-	entry.SessionActivity = time.Now()
-
-	if info.msg_type == 'D' {
+	if info.counters {
+		entry.C2Spackets = info.origPackets
+		entry.S2Cpackets = info.replPackets
+	}
+	entry.ConnMark = info.mark
+	entry.Zone = info.zone
+	entry.Status = info.status
+	entry.TCPState = info.tcpState
+	entry.Timeout = info.timeout
+
+	entry.SessionActivity = current
+
+	if message == 'D' {
 		entry.PurgeFlag = true
 	} else {
 		entry.PurgeFlag = false
@@ -300,47 +542,37 @@ func go_conntrack_callback(info *C.struct_conntrack_info) {
 
 	support.InsertConntrackEntry(finder, entry)
 
-	// ********** Call all plugin conntrack handler functions here
-
-	go example.Plugin_conntrack_handler(int(info.msg_type), &entry)
-
-	// ********** End of plugin netfilter callback functions
+	// call the conntrack handler for every plugin that has one
+	for _, handler := range support.GetConntrackPlugins() {
+		go support.RunConntrackHandler(handler, message, &entry)
+	}
 
+	// the session ends with the conntrack entry
+	if message == 'D' {
+		support.RemoveSessionId(session.SessionId, info.tuple, packet)
+		support.LogMessage("SESSION Removing %s from table\n", support.Tuple2String(session.SessionTuple))
+	}
 }
 
 /*---------------------------------------------------------------------------*/
-//export go_netlogger_callback
-func go_netlogger_callback(info *C.struct_netlogger_info) {
-	var logger support.Logger
-
-	logger.Protocol = uint8(info.protocol)
-	logger.IcmpType = uint16(info.icmp_type)
-	logger.SrcIntf = uint8(info.src_intf)
-	logger.DstIntf = uint8(info.dst_intf)
-	logger.SrcAddr = uint32(info.src_addr)
-	logger.DstAddr = uint32(info.dst_addr)
-	logger.SrcPort = uint16(info.src_port)
-	logger.DstPort = uint16(info.dst_port)
-	logger.Mark = uint32(info.mark)
-	logger.Prefix = C.GoString(info.prefix)
-
-	// ********** Call all plugin netlogger handler functions here
-
-	go example.Plugin_netlogger_handler(&logger)
-
-	// ********** End of plugin netlogger callback functions
-}
 
-/*---------------------------------------------------------------------------*/
-//export go_child_startup
-func go_child_startup() {
-	childsync.Add(1)
-}
+/*
+ * packetTuple returns the tuple the packets for a conntrack entry have in
+ * the client to server direction when they reach the queue, which is after
+ * DNAT and before SNAT. The client is from the original tuple and the
+ * server is the source of the reply tuple, which is the DNAT destination.
+ * The tuple is returned when the reply tuple is not known, which the cgo
+ * backend gives us as a zero address.
+ */
+func packetTuple(tuple support.Tuple, reply support.Tuple) support.Tuple {
+	if (reply.ClientAddr == nil) || reply.ClientAddr.IsUnspecified() {
+		return (tuple)
+	}
 
-/*---------------------------------------------------------------------------*/
-//export go_child_goodbye
-func go_child_goodbye() {
-	childsync.Done()
+	packet := tuple
+	packet.ServerAddr = reply.ClientAddr
+	packet.ServerPort = reply.ClientPort
+	return (packet)
 }
 
 /*---------------------------------------------------------------------------*/
@@ -0,0 +1,205 @@
+package main
+
+import "net"
+import "sync"
+import "syscall"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The NFQUEUE interface only supports accept, drop, and repeat verdicts, so
+ * to reject a packet we drop it and send a TCP reset or ICMP port unreachable
+ * back to the sender ourselves, the same way the iptables REJECT target does.
+ * We keep a separate raw socket for each address family.
+ */
+var rejectSocket4 int = -1
+var rejectSocket6 int = -1
+var rejectMutex sync.Mutex
+
+/*
+ * An ICMPv6 error must fit in the minimum IPv6 MTU so this is the most of
+ * the original packet we can include after the IPv6 and ICMPv6 headers.
+ */
+const icmp6ErrorData = 1280 - 40 - 8
+
+/*---------------------------------------------------------------------------*/
+func sendReject(packet gopacket.Packet) {
+	var reply []gopacket.SerializableLayer
+	var network gopacket.NetworkLayer
+	var target net.IP
+
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv4)
+		target = ip.SrcIP
+		network = &layers.IPv4{
+			Version: 4,
+			IHL:     5,
+			TTL:     64,
+			SrcIP:   ip.DstIP,
+			DstIP:   ip.SrcIP,
+		}
+	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv6)
+		target = ip.SrcIP
+		network = &layers.IPv6{
+			Version:  6,
+			HopLimit: 64,
+			SrcIP:    ip.DstIP,
+			DstIP:    ip.SrcIP,
+		}
+	} else {
+		return
+	}
+
+	// never send an error about an error
+	if isICMPError(packet) {
+		return
+	}
+
+	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp := tcpLayer.(*layers.TCP)
+
+		// never answer a reset with a reset
+		if tcp.RST {
+			return
+		}
+
+		rtcp := &layers.TCP{
+			SrcPort: tcp.DstPort,
+			DstPort: tcp.SrcPort,
+			RST:     true,
+			Window:  0,
+		}
+
+		if tcp.ACK {
+			rtcp.Seq = tcp.Ack
+		} else {
+			rtcp.ACK = true
+			rtcp.Ack = tcp.Seq + uint32(len(tcp.Payload))
+			if tcp.SYN {
+				rtcp.Ack++
+			}
+			if tcp.FIN {
+				rtcp.Ack++
+			}
+		}
+
+		setReplyProtocol(network, layers.IPProtocolTCP)
+		reply = append(reply, network.(gopacket.SerializableLayer), rtcp)
+	} else if ip, ok := network.(*layers.IPv4); ok {
+		original := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+
+		// the ICMP error carries the original IP header and 8 bytes of payload
+		data := make([]byte, 0, len(original.Contents)+8)
+		data = append(data, original.Contents...)
+		if len(original.Payload) > 8 {
+			data = append(data, original.Payload[:8]...)
+		} else {
+			data = append(data, original.Payload...)
+		}
+
+		ip.Protocol = layers.IPProtocolICMPv4
+		ricmp := &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort),
+		}
+		reply = append(reply, ip, ricmp, gopacket.Payload(data))
+	} else {
+		ip := network.(*layers.IPv6)
+
+		// the ICMPv6 error has four unused bytes followed by as much of the
+		// original packet as will fit in the minimum IPv6 MTU
+		original := packet.Data()
+		if len(original) > icmp6ErrorData {
+			original = original[:icmp6ErrorData]
+		}
+		data := make([]byte, 4, len(original)+4)
+		data = append(data, original...)
+
+		ip.NextHeader = layers.IPProtocolICMPv6
+		ricmp := &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable),
+		}
+		reply = append(reply, ip, ricmp, gopacket.Payload(data))
+	}
+
+	data, err := support.BuildPacket(reply...)
+	if err != nil {
+		support.LogMessage("Error serializing reject packet: %s\n", err)
+		return
+	}
+
+	rejectMutex.Lock()
+	defer rejectMutex.Unlock()
+
+	if target.To4() != nil {
+		var address syscall.SockaddrInet4
+		copy(address.Addr[:], target.To4())
+		err = sendRaw(&rejectSocket4, syscall.AF_INET, data, &address)
+	} else {
+		var address syscall.SockaddrInet6
+		copy(address.Addr[:], target.To16())
+		err = sendRaw(&rejectSocket6, syscall.AF_INET6, data, &address)
+	}
+
+	if err != nil {
+		support.LogMessage("Error sending reject to %s: %s\n", target, err)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * isICMPError returns true for the ICMP and ICMPv6 error messages, which
+ * RFC 1122 and RFC 4443 say must never be answered with another error.
+ * For ICMPv6 the error messages are the types below 128.
+ */
+func isICMPError(packet gopacket.Packet) bool {
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		switch icmpLayer.(*layers.ICMPv4).TypeCode.Type() {
+		case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+			return true
+		}
+	}
+
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		return (icmpLayer.(*layers.ICMPv6).TypeCode.Type() < 128)
+	}
+
+	return false
+}
+
+/*---------------------------------------------------------------------------*/
+func setReplyProtocol(network gopacket.NetworkLayer, protocol layers.IPProtocol) {
+	switch ip := network.(type) {
+	case *layers.IPv4:
+		ip.Protocol = protocol
+	case *layers.IPv6:
+		ip.NextHeader = protocol
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * sendRaw sends a packet that already includes the IP header. A raw socket
+ * with IPPROTO_RAW implies the header is included for both IPv4 and IPv6.
+ * The caller must hold the rejectMutex.
+ */
+func sendRaw(socket *int, family int, data []byte, address syscall.Sockaddr) error {
+	var err error
+
+	if *socket < 0 {
+		*socket, err = syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+		if err != nil {
+			*socket = -1
+			return err
+		}
+	}
+
+	return (syscall.Sendto(*socket, data, 0, address))
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,45 @@
+package main
+
+import "net"
+import "testing"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+
+/*---------------------------------------------------------------------------*/
+func TestIsICMPError(t *testing.T) {
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: net.ParseIP("10.1.0.1").To4(), DstIP: net.ParseIP("10.1.0.2").To4()}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+
+	for _, test := range []struct {
+		layers []gopacket.SerializableLayer
+		first  gopacket.LayerType
+		error  bool
+	}{
+		{[]gopacket.SerializableLayer{ip4, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}}, layers.LayerTypeIPv4, true},
+		{[]gopacket.SerializableLayer{ip4, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, 0)}}, layers.LayerTypeIPv4, true},
+		{[]gopacket.SerializableLayer{ip4, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}}, layers.LayerTypeIPv4, false},
+		{[]gopacket.SerializableLayer{ip6, &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)}}, layers.LayerTypeIPv6, true},
+		{[]gopacket.SerializableLayer{ip6, &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}}, layers.LayerTypeIPv6, false},
+	} {
+		buffer := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, append(test.layers, gopacket.Payload(make([]byte, 8)))...); err != nil {
+			t.Fatalf("unable to build the test packet: %s", err)
+		}
+
+		packet := gopacket.NewPacket(buffer.Bytes(), test.first, gopacket.Default)
+		if isICMPError(packet) != test.error {
+			t.Errorf("isICMPError is %v for %v", !test.error, test.layers[1])
+		}
+	}
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: ip4.SrcIP, DstIP: ip4.DstIP}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, ip, &layers.UDP{SrcPort: 40000, DstPort: 53}); err != nil {
+		t.Fatalf("unable to build the test packet: %s", err)
+	}
+	if isICMPError(gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)) {
+		t.Errorf("isICMPError is true for a UDP packet")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,227 @@
+package main
+
+import "io"
+import "os"
+import "bufio"
+import "strings"
+import "encoding/binary"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+import "github.com/google/gopacket/pcapgo"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The replay input reads packets from a pcap or pcapng file and passes them
+ * to netfilterHandler in place of the netfilter queues, so the plugins can
+ * be tested without a live system or netfilter privileges. Conntrack new
+ * and destroy events are synthesized for each flow, and the connmark bypass
+ * done by the update_rules script is simulated by skipping the rest of a
+ * flow once the verdict has the bypass mark.
+ */
+type replayFlow struct {
+	tuple       support.Tuple
+	origPackets uint64
+	origBytes   uint64
+	replPackets uint64
+	replBytes   uint64
+	finished    int
+	bypass      bool
+}
+
+type replaySource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+const (
+	replayOrigFin = 1
+	replayReplFin = 2
+)
+
+// the first four bytes of a pcapng file are the section header block type
+const pcapngMagic = 0x0A0D0D0A
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * replayCapture sends every TCP and UDP packet in the file through the
+ * normal packet path and closes done when finished.
+ */
+func replayCapture(filename string, done chan bool) {
+	defer close(done)
+
+	support.LogMessage("Replaying packets from %s\n", filename)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		support.LogMessage("Error opening replay file: %s\n", err)
+		return
+	}
+	defer file.Close()
+
+	source, err := openReplaySource(bufio.NewReader(file))
+	if err != nil {
+		support.LogMessage("Error reading replay file %s: %s\n", filename, err)
+		return
+	}
+
+	flows := make(map[string]*replayFlow)
+
+	for {
+		data, _, err := source.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			support.LogMessage("Error reading replay file %s: %s\n", filename, err)
+			break
+		}
+
+		support.IncrementCounter("replay.packets")
+		replayPacket(flows, source.LinkType(), data)
+	}
+
+	// anything still open at the end of the capture is destroyed
+	for key, flow := range flows {
+		replayDestroy(flow)
+		delete(flows, key)
+	}
+
+	support.LogMessage("Finished replaying packets from %s\n", filename)
+}
+
+/*---------------------------------------------------------------------------*/
+func openReplaySource(reader *bufio.Reader) (replaySource, error) {
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	// the section header block type reads the same in either byte order
+	if binary.BigEndian.Uint32(magic) == pcapngMagic {
+		return pcapgo.NewNgReader(reader, pcapgo.DefaultNgReaderOptions)
+	}
+
+	return pcapgo.NewReader(reader)
+}
+
+/*---------------------------------------------------------------------------*/
+func replayPacket(flows map[string]*replayFlow, linkType layers.LinkType, data []byte) {
+	var tuple support.Tuple
+	var tcp *layers.TCP
+
+	// the netfilter queue gives us packets starting with the IP header
+	// so we strip the link layer and make a copy the handlers can keep
+	decoded := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	network := decoded.NetworkLayer()
+	if network == nil {
+		support.IncrementCounter("replay.skipped")
+		return
+	}
+
+	switch layer := network.(type) {
+	case *layers.IPv4:
+		tuple.ClientAddr = layer.SrcIP
+		tuple.ServerAddr = layer.DstIP
+	case *layers.IPv6:
+		tuple.ClientAddr = layer.SrcIP
+		tuple.ServerAddr = layer.DstIP
+	default:
+		support.IncrementCounter("replay.skipped")
+		return
+	}
+
+	// only TCP and UDP are sent to the queue by the update_rules script
+	if layer := decoded.Layer(layers.LayerTypeTCP); layer != nil {
+		tcp = layer.(*layers.TCP)
+		tuple.Protocol = uint8(layers.IPProtocolTCP)
+		tuple.ClientPort = uint16(tcp.SrcPort)
+		tuple.ServerPort = uint16(tcp.DstPort)
+	} else if layer := decoded.Layer(layers.LayerTypeUDP); layer != nil {
+		udp := layer.(*layers.UDP)
+		tuple.Protocol = uint8(layers.IPProtocolUDP)
+		tuple.ClientPort = uint16(udp.SrcPort)
+		tuple.ServerPort = uint16(udp.DstPort)
+	} else {
+		support.IncrementCounter("replay.skipped")
+		return
+	}
+
+	buffer := make([]byte, 0, len(network.LayerContents())+len(network.LayerPayload()))
+	buffer = append(buffer, network.LayerContents()...)
+	buffer = append(buffer, network.LayerPayload()...)
+	tuple = support.CopyTuple(tuple)
+
+	// find the flow in either direction or create a new one
+	original := true
+	key := support.Tuple2String(tuple)
+	flow, found := flows[key]
+
+	if !found {
+		reverse := support.Tuple2String(support.ReverseTuple(tuple))
+		if flow, found = flows[reverse]; found {
+			key = reverse
+			original = false
+		}
+	}
+
+	if !found {
+		flow = &replayFlow{tuple: tuple}
+		flows[key] = flow
+		conntrackHandler(&conntrackInfo{message: 'N', tuple: flow.tuple})
+	}
+
+	if original {
+		flow.origPackets++
+		flow.origBytes += uint64(len(buffer))
+	} else {
+		flow.replPackets++
+		flow.replBytes += uint64(len(buffer))
+	}
+
+	if flow.bypass {
+		support.IncrementCounter("replay.bypassed")
+	} else {
+		verdict, _ := netfilterHandler(0, 0, buffer)
+		support.IncrementCounter("replay." + strings.ToLower(verdict.Action.String()))
+		if (verdict.Mark & support.BypassMark) != 0 {
+			flow.bypass = true
+		}
+	}
+
+	// a TCP flow is destroyed after a reset or a FIN in both directions
+	if tcp == nil {
+		return
+	}
+
+	if tcp.FIN && original {
+		flow.finished |= replayOrigFin
+	}
+	if tcp.FIN && !original {
+		flow.finished |= replayReplFin
+	}
+
+	if tcp.RST || (flow.finished == (replayOrigFin | replayReplFin)) {
+		replayDestroy(flow)
+		delete(flows, key)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * replayDestroy sends the destroy event for a flow with the counts, which
+ * like the kernel are only sent with the destroy.
+ */
+func replayDestroy(flow *replayFlow) {
+	info := conntrackInfo{message: 'D', tuple: flow.tuple, counters: true}
+	info.origPackets = flow.origPackets
+	info.origBytes = flow.origBytes
+	info.replPackets = flow.replPackets
+	info.replBytes = flow.replBytes
+	conntrackHandler(&info)
+}
+
+/*---------------------------------------------------------------------------*/
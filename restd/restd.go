@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/untangle/packetd/reports"
+	"github.com/untangle/packetd/support"
 	"io/ioutil"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var engine *gin.Engine
@@ -65,9 +67,152 @@ func reportsCreateQuery(c *gin.Context) {
 	// })
 }
 
+func statusCounters(c *gin.Context) {
+	c.JSON(200, support.GetCounters())
+}
+
+func statusMarks(c *gin.Context) {
+	c.JSON(200, support.GetMarkLayout())
+}
+
+func statusNetfilter(c *gin.Context) {
+	c.JSON(200, support.GetQueueConfig())
+}
+
+func statusOverload(c *gin.Context) {
+	c.JSON(200, support.GetOverloadStatus())
+}
+
+// the capture filter fields plus the packet limit and duration in seconds
+type captureRequest struct {
+	support.CaptureFilter
+	Limit    int
+	Duration int
+}
+
+func captureStart(c *gin.Context) {
+	var request captureRequest
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	if err = json.Unmarshal(body, &request); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+
+	status, err := support.StartCapture(request.CaptureFilter, request.Limit, time.Duration(request.Duration)*time.Second)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, status)
+}
+
+func captureStop(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("capture_id"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+
+	status, err := support.StopCapture(id)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, status)
+}
+
+func captureRemove(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("capture_id"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = support.RemoveCapture(id); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": "OK"})
+}
+
+// the session tuple fields plus how long to block the tuple in seconds
+type killRequest struct {
+	support.Tuple
+	Block int
+}
+
+func sessionKill(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("session_id"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+
+	block, err := strconv.Atoi(c.DefaultQuery("block", "0"))
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = support.KillSession(id, time.Duration(block)*time.Second); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": "OK"})
+}
+
+func sessionKillTuple(c *gin.Context) {
+	var request killRequest
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	if err = json.Unmarshal(body, &request); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	if (request.ClientAddr == nil) || (request.ServerAddr == nil) {
+		c.JSON(200, gin.H{"error": "ClientAddr and ServerAddr are required"})
+		return
+	}
+
+	if err = support.KillTuple(request.Tuple, time.Duration(request.Block)*time.Second); err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": "OK"})
+}
+
+func captureStatus(c *gin.Context) {
+	c.JSON(200, support.GetCaptures())
+}
+
+func captureDownload(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("capture_id"), 10, 64)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename, err := support.GetCaptureFile(id)
+	if err != nil {
+		c.JSON(200, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=capture-%d.pcapng", id))
+	c.File(filename)
+}
+
 func getSettings(c *gin.Context) {
 	path := c.Param("path")
-	jsonObject, err := readSettingsFile()
+	jsonObject, err := support.ReadSettingsFile()
 	if err != nil {
 		c.JSON(200, gin.H{"error": err})
 		return
@@ -119,7 +264,7 @@ func setSettings(c *gin.Context) {
 	}
 
 	if path != "" {
-		jsonObject, err = readSettingsFile()
+		jsonObject, err = support.ReadSettingsFile()
 		if err != nil {
 			c.JSON(200, gin.H{"error": err})
 			return
@@ -187,11 +332,15 @@ func setSettings(c *gin.Context) {
 		return
 	}
 
-	err = ioutil.WriteFile("/etc/config/settings.json", jsonString, 0644)
+	err = ioutil.WriteFile(support.SettingsFile, jsonString, 0644)
 	if err != nil {
 		c.JSON(200, gin.H{"error": err})
 		return
 	}
+
+	// start, stop, or reconfigure plugins to match the new settings
+	support.ApplyPluginSettings()
+
 	c.JSON(200, gin.H{"result": "OK"})
 }
 
@@ -208,6 +357,17 @@ func StartRestDaemon() {
 	engine.GET("/settings/get_settings/*path", getSettings)
 	engine.POST("/settings/set_settings", setSettings)
 	engine.POST("/settings/set_settings/*path", setSettings)
+	engine.GET("/status/counters", statusCounters)
+	engine.GET("/status/marks", statusMarks)
+	engine.GET("/status/netfilter", statusNetfilter)
+	engine.GET("/status/overload", statusOverload)
+	engine.POST("/capture/start", captureStart)
+	engine.POST("/capture/stop/:capture_id", captureStop)
+	engine.POST("/capture/remove/:capture_id", captureRemove)
+	engine.GET("/capture/status", captureStatus)
+	engine.GET("/capture/download/:capture_id", captureDownload)
+	engine.POST("/session/kill", sessionKillTuple)
+	engine.POST("/session/kill/:session_id", sessionKill)
 
 	// listen and serve on 0.0.0.0:8080
 	engine.Run()
@@ -215,19 +375,6 @@ func StartRestDaemon() {
 	fmt.Println("Started RestD")
 }
 
-func readSettingsFile() (interface{}, error) {
-	raw, err := ioutil.ReadFile("/etc/config/settings.json")
-	if err != nil {
-		return nil, err
-	}
-	var jsonObject interface{}
-	err = json.Unmarshal(raw, &jsonObject)
-	if err != nil {
-		return nil, err
-	}
-	return jsonObject, nil
-}
-
 func removeEmptyStrings(strings []string) []string {
 
 	b := strings[:0]
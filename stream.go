@@ -0,0 +1,240 @@
+package main
+
+import "net"
+import "sync"
+import "time"
+import "encoding/binary"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+import "github.com/google/gopacket/tcpassembly"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The TCP packets for sessions with stream subscribers are passed to a
+ * tcpassembly Assembler that delivers the ordered bytes for each direction.
+ * Packets for the same session can arrive on any queue, so there is a single
+ * assembler protected by a mutex, and the out of order data it buffers is
+ * limited by the page flags. The bytes are copied and handed to a pool of
+ * stream workers so a slow plugin never holds up the queue. Each session
+ * always uses the same worker so the data is delivered in order, and when
+ * the worker backlog is full the data is dropped and the next delivery for
+ * the stream is marked as skipped. Plugins may need the close to clean up,
+ * so it is never dropped. Since the assembler calls ReassemblyComplete with
+ * the mutex held the close is added to a list instead, and streamCloser
+ * passes the list to the workers without holding the mutex. Everything
+ * handed to a worker or the list is counted in streamPending until the
+ * worker is done with it, so streamGoodbye can wait for the last of it.
+ */
+type sessionStream struct {
+	session        *support.SessionEntry
+	clientToServer bool
+	skipped        bool
+	worker         chan *support.StreamData
+}
+
+type streamFactory struct {
+}
+
+type streamClose struct {
+	data   *support.StreamData
+	worker chan *support.StreamData
+}
+
+/*
+ * A gap in a stream is skipped once the data after it has waited for the
+ * gap timeout, and a stream with no packets for the idle timeout is closed.
+ */
+const streamGapTimeout = 2 * time.Second
+const streamIdleTimeout = 10 * time.Minute
+const streamBacklog = 256
+
+var streamConnPages int
+var streamTotalPages int
+var streamAssembler *tcpassembly.Assembler
+var streamMutex sync.Mutex
+var streamWorkers []chan *support.StreamData
+var streamClosed []streamClose
+var streamSignal = make(chan bool, 1)
+var streamPending sync.WaitGroup
+var streamStopped bool
+
+/*---------------------------------------------------------------------------*/
+func streamStartup(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	streamAssembler = tcpassembly.NewAssembler(tcpassembly.NewStreamPool(&streamFactory{}))
+	streamAssembler.MaxBufferedPagesPerConnection = streamConnPages
+	streamAssembler.MaxBufferedPagesTotal = streamTotalPages
+
+	streamWorkers = make([]chan *support.StreamData, workers)
+	for i := range streamWorkers {
+		streamWorkers[i] = make(chan *support.StreamData, streamBacklog)
+		go streamWorker(streamWorkers[i])
+	}
+
+	go streamFlusher()
+	go streamCloser()
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * streamGoodbye delivers whatever is still buffered, closes every stream,
+ * and waits for the workers to pass it all to the plugins. Packets that
+ * arrive after this are not assembled, so nothing is added to the pending
+ * count while we wait for it.
+ */
+func streamGoodbye() {
+	streamMutex.Lock()
+	streamAssembler.FlushAll()
+	streamStopped = true
+	streamMutex.Unlock()
+
+	streamPending.Wait()
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * streamPacket is called by netfilterHandler for every accepted TCP packet.
+ * The packet is only assembled when the session has stream subscribers.
+ */
+func streamPacket(session *support.SessionEntry, network gopacket.NetworkLayer, tcp *layers.TCP) {
+	if session.StreamCount() == 0 {
+		return
+	}
+
+	streamMutex.Lock()
+	if !streamStopped {
+		streamAssembler.AssembleWithTimestamp(network.NetworkFlow(), tcp, time.Now())
+	}
+	streamMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func streamFlusher() {
+	for {
+		time.Sleep(time.Second)
+
+		current := time.Now()
+		streamMutex.Lock()
+		streamAssembler.FlushWithOptions(tcpassembly.FlushOptions{T: current.Add(-streamGapTimeout)})
+		streamAssembler.FlushOlderThan(current.Add(-streamIdleTimeout))
+		streamMutex.Unlock()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func streamCloser() {
+	for range streamSignal {
+		streamMutex.Lock()
+		list := streamClosed
+		streamClosed = nil
+		streamMutex.Unlock()
+
+		for _, item := range list {
+			item.worker <- item.data
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func streamWorker(worker chan *support.StreamData) {
+	for stream := range worker {
+		for _, handler := range support.GetStreamPlugins() {
+			if stream.Session.IsStreamSubscribed(handler.Name()) {
+				support.RunStreamHandler(handler, stream)
+			}
+		}
+		streamPending.Done()
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * New is called by the assembler for the first packet in each direction.
+ * The flows are in the packet direction so we find the session the same way
+ * netfilterHandler does.
+ */
+func (factory *streamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	var tuple support.Tuple
+
+	tuple.Protocol = uint8(layers.IPProtocolTCP)
+	tuple.ClientAddr = net.IP(netFlow.Src().Raw())
+	tuple.ClientPort = binary.BigEndian.Uint16(tcpFlow.Src().Raw())
+	tuple.ServerAddr = net.IP(netFlow.Dst().Raw())
+	tuple.ServerPort = binary.BigEndian.Uint16(tcpFlow.Dst().Raw())
+
+	stream := new(sessionStream)
+
+	session, ok := support.FindSessionTuple(tuple)
+	if !ok {
+		return (stream)
+	}
+
+	stream.session = session
+	stream.clientToServer = session.SessionTuple.ClientAddr.Equal(tuple.ClientAddr) && (session.SessionTuple.ClientPort == tuple.ClientPort)
+	stream.worker = streamWorkers[session.SessionId%uint64(len(streamWorkers))]
+	return (stream)
+}
+
+/*---------------------------------------------------------------------------*/
+func (stream *sessionStream) Reassembled(list []tcpassembly.Reassembly) {
+	if stream.session == nil {
+		return
+	}
+
+	for _, item := range list {
+		// the skip is -1 when the start of the stream was never seen
+		if item.Skip != 0 {
+			support.IncrementCounter("stream.skipped")
+			stream.skipped = true
+		}
+
+		if len(item.Bytes) == 0 {
+			continue
+		}
+
+		data := &support.StreamData{Session: stream.session, ClientToServer: stream.clientToServer, Skipped: stream.skipped}
+		data.Data = append([]byte(nil), item.Bytes...)
+
+		streamPending.Add(1)
+
+		select {
+		case stream.worker <- data:
+			stream.skipped = false
+		default:
+			streamPending.Done()
+			support.IncrementCounter("stream.overflow")
+			stream.skipped = true
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ReassemblyComplete is always called by the assembler with streamMutex
+ * held, so the close is added to the list for streamCloser.
+ */
+func (stream *sessionStream) ReassemblyComplete() {
+	if stream.session == nil {
+		return
+	}
+
+	data := &support.StreamData{Session: stream.session, ClientToServer: stream.clientToServer, Skipped: stream.skipped, Closed: true}
+	streamPending.Add(1)
+	streamClosed = append(streamClosed, streamClose{data: data, worker: stream.worker})
+
+	select {
+	case streamSignal <- true:
+	default:
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,83 @@
+package main
+
+import "time"
+import "sync/atomic"
+import "testing"
+import "github.com/untangle/packetd/support"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * A close for a stream whose worker is busy must not hold the assembler
+ * lock, and must still be delivered once the worker is ready.
+ */
+func TestStreamCloseNeverBlocks(t *testing.T) {
+	testStartup()
+	worker := make(chan *support.StreamData)
+	stream := &sessionStream{session: &support.SessionEntry{}, worker: worker}
+
+	done := make(chan bool)
+	go func() {
+		streamMutex.Lock()
+		stream.ReassemblyComplete()
+		streamMutex.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("ReassemblyComplete blocked with the assembler lock held")
+	}
+
+	select {
+	case data := <-worker:
+		streamPending.Done()
+		if !data.Closed {
+			t.Errorf("the stream data is not a close")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the close was never delivered")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The plugins are stopped right after streamGoodbye, so it must not return
+ * until the workers have delivered the closes to the stream handlers.
+ */
+func TestStreamGoodbyeDrains(t *testing.T) {
+	testStartup()
+	var closed int32
+
+	setStreamHandler(t, func(stream *support.StreamData) {
+		time.Sleep(50 * time.Millisecond)
+		if stream.Closed {
+			atomic.AddInt32(&closed, 1)
+		}
+	})
+
+	session := &support.SessionEntry{}
+	session.SubscribeStream("test")
+
+	streamMutex.Lock()
+	for _, direction := range []bool{true, false} {
+		stream := &sessionStream{session: session, clientToServer: direction, worker: streamWorkers[0]}
+		stream.ReassemblyComplete()
+	}
+	streamMutex.Unlock()
+
+	t.Cleanup(func() {
+		streamMutex.Lock()
+		streamStopped = false
+		streamMutex.Unlock()
+	})
+
+	streamGoodbye()
+	if count := atomic.LoadInt32(&closed); count != 2 {
+		t.Errorf("streamGoodbye returned after %d of 2 closes", count)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
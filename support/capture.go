@@ -0,0 +1,360 @@
+package support
+
+import "os"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+import "bufio"
+import "sync/atomic"
+import "path/filepath"
+import "encoding/binary"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * A capture copies the packets that match a filter to a pcapng file that
+ * can be downloaded with the REST API once the capture is stopped. The
+ * filter matches a session ID, or any combination of the tuple fields in
+ * either direction where zero values match anything. Each packet comment
+ * holds the session ID and the verdict for the packet.
+ */
+type CaptureFilter struct {
+	SessionId  uint64
+	Protocol   uint8
+	ClientAddr net.IP
+	ClientPort uint16
+	ServerAddr net.IP
+	ServerPort uint16
+}
+
+/*
+ * CaptureStatus is returned by the capture REST calls. A capture stops
+ * when it reaches the packet limit or the duration, or when stopped with
+ * the REST API.
+ */
+type CaptureStatus struct {
+	CaptureId uint64
+	Filter    CaptureFilter
+	Limit     int
+	Duration  time.Duration
+	Started   time.Time
+	Stopped   time.Time
+	Running   bool
+	Packets   int
+	Bytes     uint64
+	Filename  string
+}
+
+type captureHolder struct {
+	status CaptureStatus
+	file   *os.File
+	writer *bufio.Writer
+	timer  *time.Timer
+}
+
+const (
+	DefaultCaptureLimit    = 10000
+	MaxCaptureLimit        = 1000000
+	DefaultCaptureDuration = time.Minute
+	MaxCaptureDuration     = time.Hour
+	MaxCaptureCount        = 8
+)
+
+// pcapng block types and the raw IP link type since we only see IP packets
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrder      = 0x1A2B3C4D
+	pcapngLinkTypeRaw    = 101
+	pcapngOptionComment  = 1
+)
+
+var captureTable = make(map[uint64]*captureHolder)
+var captureMutex sync.Mutex
+var captureIndex uint64
+var captureActive int32
+
+/*---------------------------------------------------------------------------*/
+func (filter CaptureFilter) matches(session uint64, tuple Tuple) bool {
+	if (filter.SessionId != 0) && (filter.SessionId != session) {
+		return false
+	}
+	if (filter.Protocol != 0) && (filter.Protocol != tuple.Protocol) {
+		return false
+	}
+
+	forward := matchEndpoint(filter.ClientAddr, filter.ClientPort, tuple.ClientAddr, tuple.ClientPort) && matchEndpoint(filter.ServerAddr, filter.ServerPort, tuple.ServerAddr, tuple.ServerPort)
+	reverse := matchEndpoint(filter.ClientAddr, filter.ClientPort, tuple.ServerAddr, tuple.ServerPort) && matchEndpoint(filter.ServerAddr, filter.ServerPort, tuple.ClientAddr, tuple.ClientPort)
+	return (forward || reverse)
+}
+
+/*---------------------------------------------------------------------------*/
+func matchEndpoint(addr net.IP, port uint16, packetAddr net.IP, packetPort uint16) bool {
+	if (addr != nil) && !addr.Equal(packetAddr) {
+		return false
+	}
+	if (port != 0) && (port != packetPort) {
+		return false
+	}
+	return true
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * StartCapture creates the capture file and arms a capture for the filter.
+ * A zero limit or duration uses the default value.
+ */
+func StartCapture(filter CaptureFilter, limit int, duration time.Duration) (CaptureStatus, error) {
+	if (filter.SessionId == 0) && (filter.Protocol == 0) && (filter.ClientAddr == nil) && (filter.ClientPort == 0) && (filter.ServerAddr == nil) && (filter.ServerPort == 0) {
+		return CaptureStatus{}, fmt.Errorf("capture filter must have a session or tuple value")
+	}
+	if limit == 0 {
+		limit = DefaultCaptureLimit
+	}
+	if (limit < 0) || (limit > MaxCaptureLimit) {
+		return CaptureStatus{}, fmt.Errorf("capture limit %d must be between 1 and %d", limit, MaxCaptureLimit)
+	}
+	if duration == 0 {
+		duration = DefaultCaptureDuration
+	}
+	if (duration < 0) || (duration > MaxCaptureDuration) {
+		return CaptureStatus{}, fmt.Errorf("capture duration %s must be between 1s and %s", duration, MaxCaptureDuration)
+	}
+
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+
+	running := 0
+	for _, holder := range captureTable {
+		if holder.status.Running {
+			running++
+		}
+	}
+	if running >= MaxCaptureCount {
+		return CaptureStatus{}, fmt.Errorf("too many active captures")
+	}
+
+	captureIndex++
+	holder := new(captureHolder)
+	holder.status.CaptureId = captureIndex
+	holder.status.Filter = filter
+	holder.status.Limit = limit
+	holder.status.Duration = duration
+	holder.status.Filename = filepath.Join(os.TempDir(), fmt.Sprintf("packetd-capture-%d.pcapng", captureIndex))
+
+	file, err := os.Create(holder.status.Filename)
+	if err != nil {
+		return CaptureStatus{}, err
+	}
+
+	holder.file = file
+	holder.writer = bufio.NewWriter(file)
+	if err = writeCaptureHeader(holder.writer); err != nil {
+		file.Close()
+		return CaptureStatus{}, err
+	}
+
+	holder.status.Started = time.Now()
+	holder.status.Running = true
+	captureTable[holder.status.CaptureId] = holder
+	atomic.AddInt32(&captureActive, 1)
+
+	id := holder.status.CaptureId
+	holder.timer = time.AfterFunc(duration, func() { StopCapture(id) })
+
+	LogMessage("Started capture %d\n", id)
+	return holder.status, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func StopCapture(id uint64) (CaptureStatus, error) {
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+
+	holder, ok := captureTable[id]
+	if !ok {
+		return CaptureStatus{}, fmt.Errorf("capture %d not found", id)
+	}
+
+	holder.finish()
+	return holder.status, nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * RemoveCapture stops the capture if it is still running and deletes the
+ * capture file.
+ */
+func RemoveCapture(id uint64) error {
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+
+	holder, ok := captureTable[id]
+	if !ok {
+		return fmt.Errorf("capture %d not found", id)
+	}
+
+	holder.finish()
+	delete(captureTable, id)
+	return os.Remove(holder.status.Filename)
+}
+
+/*---------------------------------------------------------------------------*/
+func GetCaptures() []CaptureStatus {
+	captureMutex.Lock()
+	list := make([]CaptureStatus, 0, len(captureTable))
+	for _, holder := range captureTable {
+		list = append(list, holder.status)
+	}
+	captureMutex.Unlock()
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * GetCaptureFile returns the name of the file for a capture that has been
+ * stopped so it can be downloaded.
+ */
+func GetCaptureFile(id uint64) (string, error) {
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+
+	holder, ok := captureTable[id]
+	if !ok {
+		return "", fmt.Errorf("capture %d not found", id)
+	}
+	if holder.status.Running {
+		return "", fmt.Errorf("capture %d is still running", id)
+	}
+
+	return holder.status.Filename, nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * CapturePacket is called for every packet the daemon handles and writes
+ * the packet to every running capture with a matching filter. It returns
+ * right away when no captures are running.
+ */
+func CapturePacket(session uint64, tuple Tuple, data []byte, action VerdictAction) {
+	if atomic.LoadInt32(&captureActive) == 0 {
+		return
+	}
+
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+
+	for _, holder := range captureTable {
+		if !holder.status.Running || !holder.status.Filter.matches(session, tuple) {
+			continue
+		}
+
+		comment := fmt.Sprintf("session %d verdict %s", session, action)
+		if err := writeCapturePacket(holder.writer, time.Now(), data, comment); err != nil {
+			LogMessage("Error writing capture %d: %s\n", holder.status.CaptureId, err)
+			holder.finish()
+			continue
+		}
+
+		holder.status.Packets++
+		holder.status.Bytes += uint64(len(data))
+		if holder.status.Packets >= holder.status.Limit {
+			holder.finish()
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * finish flushes and closes the capture file. Must be called with the
+ * capture mutex locked.
+ */
+func (holder *captureHolder) finish() {
+	if !holder.status.Running {
+		return
+	}
+
+	holder.timer.Stop()
+	holder.writer.Flush()
+	holder.file.Close()
+	holder.status.Running = false
+	holder.status.Stopped = time.Now()
+	atomic.AddInt32(&captureActive, -1)
+
+	LogMessage("Finished capture %d with %d packets\n", holder.status.CaptureId, holder.status.Packets)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The gopacket NgWriter has no way to add a comment to a packet, so we write
+ * the few pcapng blocks we need ourselves. The file has a section header,
+ * one raw IP interface, and an enhanced packet block for each packet.
+ */
+func writeCaptureHeader(writer *bufio.Writer) error {
+	header := make([]byte, 28)
+	binary.LittleEndian.PutUint32(header[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(header[4:], 28)
+	binary.LittleEndian.PutUint32(header[8:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(header[12:], 1)
+	binary.LittleEndian.PutUint16(header[14:], 0)
+	binary.LittleEndian.PutUint64(header[16:], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint32(header[24:], 28)
+
+	intf := make([]byte, 20)
+	binary.LittleEndian.PutUint32(intf[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(intf[4:], 20)
+	binary.LittleEndian.PutUint16(intf[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(intf[12:], 0)
+	binary.LittleEndian.PutUint32(intf[16:], 20)
+
+	writer.Write(header)
+	_, err := writer.Write(intf)
+	return err
+}
+
+/*---------------------------------------------------------------------------*/
+func writeCapturePacket(writer *bufio.Writer, stamp time.Time, data []byte, comment string) error {
+	dataLen := pcapngPad(len(data))
+	commentLen := pcapngPad(len(comment))
+
+	// block header, packet fields, data, comment option, end option, trailer
+	total := 28 + dataLen + 4 + commentLen + 4 + 4
+	block := make([]byte, total)
+
+	micros := uint64(stamp.UnixNano() / 1000)
+
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(total))
+	binary.LittleEndian.PutUint32(block[8:], 0)
+	binary.LittleEndian.PutUint32(block[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(data)))
+	copy(block[28:], data)
+
+	offset := 28 + dataLen
+	binary.LittleEndian.PutUint16(block[offset:], pcapngOptionComment)
+	binary.LittleEndian.PutUint16(block[offset+2:], uint16(len(comment)))
+	copy(block[offset+4:], comment)
+
+	// the end of options is all zeros which the make already gave us
+	binary.LittleEndian.PutUint32(block[total-4:], uint32(total))
+
+	_, err := writer.Write(block)
+	return err
+}
+
+/*---------------------------------------------------------------------------*/
+func pcapngPad(length int) int {
+	return ((length + 3) &^ 3)
+}
+
+/*---------------------------------------------------------------------------*/
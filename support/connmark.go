@@ -0,0 +1,113 @@
+package support
+
+import "fmt"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The connmark and the conntrack labels stay with the connection, so unlike
+ * the verdict mark they can be used by iptables and tc rules for every
+ * packet of the session, including the ones that no longer reach the
+ * queue. The connmark uses the same layout as the packet mark since the
+ * rules copy bits between them, so a plugin can only change the connmark
+ * bits within the fields it allocated with AllocateMark. Conntrack has 128
+ * label bits, where bit n is bit n%32 of word n/32 just like the connlabel
+ * match and libnetfilter_conntrack number them. The kernel only keeps
+ * labels for connections created after a rule using the connlabel match
+ * has been loaded.
+ */
+const ConntrackLabelBits = 128
+
+/*
+ * ConntrackUpdate holds the changes for a conntrack entry. Only the connmark
+ * bits that are set in MarkMask and the label bits that are set in LabelMask
+ * are changed, so an empty update changes nothing.
+ */
+type ConntrackUpdate struct {
+	Mark      uint32
+	MarkMask  uint32
+	Labels    [ConntrackLabelBits / 32]uint32
+	LabelMask [ConntrackLabelBits / 32]uint32
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * SetMark sets the connmark bits in the mask to the bits in the value.
+ */
+func (update *ConntrackUpdate) SetMark(value uint32, mask uint32) {
+	update.Mark = (update.Mark &^ mask) | (value & mask)
+	update.MarkMask |= mask
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * SetLabelField stores a value in width label bits starting at offset,
+ * with the lowest bit of the value in the bit at offset. A single label is
+ * a field with a width of one.
+ */
+func (update *ConntrackUpdate) SetLabelField(offset uint, width uint, value uint64) error {
+	if (width == 0) || (width > 64) || ((offset + width) > ConntrackLabelBits) {
+		return fmt.Errorf("label field offset %d width %d does not fit in the labels", offset, width)
+	}
+
+	for i := uint(0); i < width; i++ {
+		bit := offset + i
+		flag := uint32(1) << (bit % 32)
+		update.LabelMask[bit/32] |= flag
+		if (value & (uint64(1) << i)) != 0 {
+			update.Labels[bit/32] |= flag
+		} else {
+			update.Labels[bit/32] &^= flag
+		}
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * UpdateConntrack changes the connmark and labels of the conntrack entry
+ * for a tuple in either direction. The owner is the plugin name, and an
+ * error is returned without changing anything if the mark mask has bits
+ * outside the mark fields allocated to the owner.
+ */
+func UpdateConntrack(owner string, tuple Tuple, update ConntrackUpdate) error {
+	control := getConntrackControl()
+	if control == nil {
+		return fmt.Errorf("conntrack control is not available")
+	}
+
+	allowed := GetOwnerMask(owner)
+	if (update.MarkMask &^ allowed) != 0 {
+		IncrementCounter("plugin." + owner + ".badmark")
+		return fmt.Errorf("connmark mask 0x%08X is outside the fields owned by %s 0x%08X", update.MarkMask, owner, allowed)
+	}
+
+	if (update.MarkMask == 0) && (update.LabelMask == [ConntrackLabelBits / 32]uint32{}) {
+		return nil
+	}
+
+	err := control.Update(tuple, update)
+	if err != nil {
+		return err
+	}
+
+	IncrementCounter("conntrack.updated")
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * SetConnmark changes the connmark bits in the mask for the conntrack entry
+ * of a tuple. It is a shortcut for UpdateConntrack with only a mark.
+ */
+func SetConnmark(owner string, tuple Tuple, value uint32, mask uint32) error {
+	var update ConntrackUpdate
+	update.SetMark(value, mask)
+	return UpdateConntrack(owner, tuple, update)
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,105 @@
+package support
+
+import "sync"
+import "github.com/google/gopacket"
+import "github.com/google/gopacket/layers"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * PacketContext is created once for every packet received from the netfilter
+ * queue and handed to every plugin netfilter handler. The packet is decoded
+ * before the handlers are called so plugins should use the decoded layers
+ * rather than decoding the raw buffer again. The Session is shared by all
+ * plugins so each plugin should only write the fields it owns. Only one
+ * of IPv4Layer and IPv6Layer is set, and plugins that just need the addresses
+ * should use the Tuple which works for both. The Tuple is always the session
+ * tuple in the client to server direction, and ClientToServer tells which
+ * way the packet is going.
+ *
+ * The Buffer is borrowed from the netfilter queue without copying, and the
+ * decoded Packet and layers point into the same memory. They are only valid
+ * until the handler returns, so a plugin that needs to keep any packet data
+ * must use CopyBuffer and return the copy with ReleaseBuffer when done.
+ * A handler that has not started when the verdict for the packet is issued
+ * is not called for that packet.
+ */
+type PacketContext struct {
+	Buffer         []byte
+	Length         int
+	Packet         gopacket.Packet
+	IPv4Layer      *layers.IPv4
+	IPv6Layer      *layers.IPv6
+	TCPLayer       *layers.TCP
+	UDPLayer       *layers.UDP
+	Tuple          Tuple
+	Session        *SessionEntry
+	ClientToServer bool
+}
+
+var bufferPool = sync.Pool{New: func() interface{} { return make([]byte, 0, 2048) }}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * CopyBuffer returns a copy of the borrowed packet buffer from a pool that
+ * the plugin owns until it passes the copy to ReleaseBuffer.
+ */
+func (ctx *PacketContext) CopyBuffer() []byte {
+	buffer := bufferPool.Get().([]byte)
+	return (append(buffer[:0], ctx.Buffer[:ctx.Length]...))
+}
+
+/*---------------------------------------------------------------------------*/
+func ReleaseBuffer(buffer []byte) {
+	bufferPool.Put(buffer[:0])
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * BuildPacket serializes the layers into a new packet that a handler can
+ * return in Verdict.Packet to replace the packet in the queue. The lengths
+ * and checksums are always recomputed, so a plugin can copy the decoded
+ * layers from the context, change the fields it needs, and pass them here
+ * followed by the payload as a gopacket.Payload.
+ */
+func BuildPacket(list ...gopacket.SerializableLayer) ([]byte, error) {
+	var network gopacket.NetworkLayer
+
+	// the TCP, UDP, and ICMPv6 checksums include the IP pseudo header
+	for _, item := range list {
+		switch layer := item.(type) {
+		case *layers.IPv4:
+			if network == nil {
+				network = layer
+			}
+		case *layers.IPv6:
+			if network == nil {
+				network = layer
+			}
+		case *layers.TCP:
+			if network != nil {
+				layer.SetNetworkLayerForChecksum(network)
+			}
+		case *layers.UDP:
+			if network != nil {
+				layer.SetNetworkLayerForChecksum(network)
+			}
+		case *layers.ICMPv6:
+			if network != nil {
+				layer.SetNetworkLayerForChecksum(network)
+			}
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buffer, options, list...)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+/*---------------------------------------------------------------------------*/
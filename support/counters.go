@@ -0,0 +1,33 @@
+package support
+
+import "sync"
+
+var counterTable = make(map[string]uint64)
+var counterMutex sync.Mutex
+
+/*---------------------------------------------------------------------------*/
+func IncrementCounter(name string) {
+	counterMutex.Lock()
+	counterTable[name]++
+	counterMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func GetCounters() map[string]uint64 {
+	counterMutex.Lock()
+	list := make(map[string]uint64, len(counterTable))
+	for key, val := range counterTable {
+		list[key] = val
+	}
+	counterMutex.Unlock()
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+func AddCounter(name string, value uint64) {
+	counterMutex.Lock()
+	counterTable[name] += value
+	counterMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
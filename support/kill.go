@@ -0,0 +1,174 @@
+package support
+
+import "fmt"
+import "sync"
+import "time"
+import "sync/atomic"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ConntrackControl is implemented by the kernel backend and set by the
+ * daemon at startup so plugins and the REST API can change the conntrack
+ * table. Destroy removes the conntrack entry for a tuple in either
+ * direction in the default zone, and Update changes the connmark and label
+ * bits selected by the masks in the update.
+ */
+type ConntrackControl interface {
+	Destroy(tuple Tuple) error
+	Update(tuple Tuple, update ConntrackUpdate) error
+}
+
+var conntrackControl ConntrackControl
+var controlMutex sync.Mutex
+
+/*
+ * A killed connection can be given a temporary block so the packets still
+ * in flight do not create a new conntrack entry and let the connection
+ * carry on. The netfilter handler drops every packet for a blocked tuple
+ * in either direction until the block expires. The blockCount lets the
+ * handler skip the table lookup when nothing is blocked.
+ */
+var blockTable = make(map[string]time.Time)
+var blockMutex sync.Mutex
+var blockCount int32
+
+/*---------------------------------------------------------------------------*/
+func SetConntrackControl(control ConntrackControl) {
+	controlMutex.Lock()
+	conntrackControl = control
+	controlMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func getConntrackControl() ConntrackControl {
+	controlMutex.Lock()
+	control := conntrackControl
+	controlMutex.Unlock()
+	return (control)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * KillSession destroys the conntrack entry for a session found by the
+ * session id in the conntrack or session table. Conntrack only matches the
+ * original or reply tuple, which for a port forward is not the tuple of the
+ * packets in the session table, so the conntrack entry is used when there
+ * is one. If block is not zero both tuples are blocked for that long.
+ */
+func KillSession(id uint64, block time.Duration) error {
+	tuple, ok := findConntrackId(id)
+	session, found := findSessionId(id)
+	if !ok && !found {
+		return fmt.Errorf("session %d not found", id)
+	}
+	if !ok {
+		tuple = session
+	}
+
+	if found && (block > 0) {
+		BlockTuple(session, block)
+	}
+	return KillTuple(tuple, block)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * KillTuple destroys the conntrack entry for a tuple in either direction.
+ * The session is removed by the destroy event for the entry, so it is left
+ * alone if the destroy fails. If block is not zero the tuple is blocked for
+ * that long, which is done first so no packets get through in between.
+ */
+func KillTuple(tuple Tuple, block time.Duration) error {
+	control := getConntrackControl()
+	if control == nil {
+		return fmt.Errorf("conntrack control is not available")
+	}
+
+	if block > 0 {
+		BlockTuple(tuple, block)
+	}
+
+	err := control.Destroy(tuple)
+	if err != nil {
+		return err
+	}
+
+	IncrementCounter("conntrack.killed")
+	LogMessage("CONNTRACK Killed %s\n", Tuple2String(tuple))
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func BlockTuple(tuple Tuple, duration time.Duration) {
+	blockMutex.Lock()
+	blockTable[Tuple2String(tuple)] = time.Now().Add(duration)
+	atomic.StoreInt32(&blockCount, int32(len(blockTable)))
+	blockMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * IsBlocked returns true if the tuple is blocked in either direction.
+ */
+func IsBlocked(tuple Tuple) bool {
+	if atomic.LoadInt32(&blockCount) == 0 {
+		return false
+	}
+
+	blockMutex.Lock()
+	defer blockMutex.Unlock()
+
+	current := time.Now()
+	for _, finder := range []string{Tuple2String(tuple), Tuple2String(ReverseTuple(tuple))} {
+		if expire, ok := blockTable[finder]; ok && current.Before(expire) {
+			return true
+		}
+	}
+	return false
+}
+
+/*---------------------------------------------------------------------------*/
+func CleanBlockTable() {
+	current := time.Now()
+
+	blockMutex.Lock()
+	for key, expire := range blockTable {
+		if current.After(expire) {
+			delete(blockTable, key)
+		}
+	}
+	atomic.StoreInt32(&blockCount, int32(len(blockTable)))
+	blockMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func findConntrackId(id uint64) (Tuple, bool) {
+	conntrackMutex.Lock()
+	defer conntrackMutex.Unlock()
+
+	for _, entry := range conntrackTable {
+		if (entry.SessionId == id) && !entry.PurgeFlag {
+			return entry.SessionTuple, true
+		}
+	}
+	return Tuple{}, false
+}
+
+/*---------------------------------------------------------------------------*/
+func findSessionId(id uint64) (Tuple, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	for _, entry := range sessionTable {
+		if entry.SessionId == id {
+			return entry.SessionTuple, true
+		}
+	}
+	return Tuple{}, false
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,128 @@
+package support
+
+import "fmt"
+import "sort"
+import "sync"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * MarkField describes a range of bits in the packet mark that belongs to a
+ * single owner. Plugins allocate the fields they need during startup and
+ * the daemon only applies the verdict mark bits that fall within the fields
+ * allocated to the plugin that returned them.
+ */
+type MarkField struct {
+	Owner  string
+	Name   string
+	Offset uint
+	Width  uint
+	Mask   uint32
+}
+
+var markTable []MarkField
+var markMutex sync.Mutex
+
+/*---------------------------------------------------------------------------*/
+func markStartup() {
+	markMutex.Lock()
+	markTable = nil
+
+	// the low 16 bits hold the source and destination interface values that
+	// are set by the firewall rules and read by the netlogger
+	markTable = append(markTable, makeMarkField("system", "src_intf", 0, 8))
+	markTable = append(markTable, makeMarkField("system", "dst_intf", 8, 8))
+
+	// the bypass bit is set by the daemon when all plugins release a session
+	markTable = append(markTable, makeMarkField("packetd", "bypass", 28, 1))
+	markMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func makeMarkField(owner string, name string, offset uint, width uint) MarkField {
+	var field MarkField
+	field.Owner = owner
+	field.Name = name
+	field.Offset = offset
+	field.Width = width
+	field.Mask = uint32(((uint64(1) << width) - 1) << offset)
+	return (field)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * AllocateMark reserves width bits at offset in the packet mark for the
+ * owner. An error is returned if the field does not fit in the mark or
+ * overlaps a field that has already been allocated.
+ */
+func AllocateMark(owner string, name string, offset uint, width uint) (MarkField, error) {
+	if (width == 0) || ((offset + width) > 32) {
+		return MarkField{}, fmt.Errorf("mark field %s.%s offset %d width %d does not fit in the mark", owner, name, offset, width)
+	}
+
+	field := makeMarkField(owner, name, offset, width)
+
+	markMutex.Lock()
+	defer markMutex.Unlock()
+
+	for _, item := range markTable {
+		if (item.Mask & field.Mask) != 0 {
+			return MarkField{}, fmt.Errorf("mark field %s.%s 0x%08X conflicts with %s.%s 0x%08X", owner, name, field.Mask, item.Owner, item.Name, item.Mask)
+		}
+	}
+
+	markTable = append(markTable, field)
+	LogMessage("MARK Allocated %s.%s mask 0x%08X\n", owner, name, field.Mask)
+	return field, nil
+}
+
+/*---------------------------------------------------------------------------*/
+func FreeMarks(owner string) {
+	markMutex.Lock()
+	list := markTable[:0]
+	for _, item := range markTable {
+		if item.Owner != owner {
+			list = append(list, item)
+		}
+	}
+	markTable = list
+	markMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func GetOwnerMask(owner string) uint32 {
+	var mask uint32
+
+	markMutex.Lock()
+	for _, item := range markTable {
+		if item.Owner == owner {
+			mask |= item.Mask
+		}
+	}
+	markMutex.Unlock()
+	return (mask)
+}
+
+/*---------------------------------------------------------------------------*/
+func GetMarkLayout() []MarkField {
+	markMutex.Lock()
+	list := make([]MarkField, len(markTable))
+	copy(list, markTable)
+	markMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Offset < list[j].Offset })
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Value shifts a value into the position of the field and masks off any
+ * bits that do not fit so it can be used as the Mark in a Verdict.
+ */
+func (field MarkField) Value(value uint32) uint32 {
+	return ((value << field.Offset) & field.Mask)
+}
+
+/*---------------------------------------------------------------------------*/
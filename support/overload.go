@@ -0,0 +1,52 @@
+package support
+
+import "sync"
+import "time"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * QueueStatus holds the values the kernel reports for one netfilter queue.
+ * Backlog is the number of packets waiting for a verdict and the dropped
+ * counts are totals since the queue was opened.
+ */
+type QueueStatus struct {
+	Queue        int
+	Backlog      int
+	QueueDropped uint64
+	UserDropped  uint64
+}
+
+/*
+ * OverloadStatus is updated by the daemon when it checks the netfilter
+ * queues and is returned by the /status/overload REST call. While Degraded
+ * is set the plugin handlers are skipped and packets get the verdict for
+ * the configured Mode.
+ */
+type OverloadStatus struct {
+	Mode          string
+	Degraded      bool
+	DegradedSince time.Time
+	Queues        []QueueStatus
+}
+
+var overloadStatus OverloadStatus
+var overloadMutex sync.Mutex
+
+/*---------------------------------------------------------------------------*/
+func SetOverloadStatus(status OverloadStatus) {
+	overloadMutex.Lock()
+	overloadStatus = status
+	overloadMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func GetOverloadStatus() OverloadStatus {
+	overloadMutex.Lock()
+	status := overloadStatus
+	status.Queues = append([]QueueStatus(nil), overloadStatus.Queues...)
+	overloadMutex.Unlock()
+	return (status)
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,487 @@
+package support
+
+import "sync"
+import "time"
+import "sync/atomic"
+import "runtime/debug"
+
+/*
+ * A plugin that panics this many times is stopped automatically. It can be
+ * started again by changing the plugin settings.
+ */
+const pluginPanicLimit = 10
+
+/*
+ * When a plugin is stopped we wait this long for the handlers that are
+ * already running to return before calling Goodbye.
+ */
+const pluginStopWait = 2 * time.Second
+
+var pluginList []*pluginHolder
+var pluginMutex sync.Mutex
+var pluginChildsync *sync.WaitGroup
+var netfilterList atomic.Value
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Every plugin must implement the Plugin interface. The netfilter, conntrack,
+ * netlogger, and stream handlers are optional, and the daemon uses a type
+ * assertion to find the plugins that implement each of them.
+ */
+type Plugin interface {
+	Name() string
+	Startup(childsync *sync.WaitGroup)
+	Goodbye(childsync *sync.WaitGroup)
+}
+
+/*---------------------------------------------------------------------------*/
+type NetfilterPlugin interface {
+	Plugin
+	NetfilterHandler(ctx *PacketContext) Verdict
+}
+
+/*---------------------------------------------------------------------------*/
+type ConntrackPlugin interface {
+	Plugin
+	ConntrackHandler(message int, entry *ConntrackEntry)
+}
+
+/*---------------------------------------------------------------------------*/
+type NetloggerPlugin interface {
+	Plugin
+	NetloggerHandler(logger *Logger)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The lists of handlers keep each plugin with its holder so the Run
+ * functions can check that the plugin is running without looking it up.
+ * The methods of the plugin can be called directly on the handle.
+ */
+type NetfilterHandle struct {
+	NetfilterPlugin
+	holder *pluginHolder
+}
+
+/*---------------------------------------------------------------------------*/
+type ConntrackHandle struct {
+	ConntrackPlugin
+	holder *pluginHolder
+}
+
+/*---------------------------------------------------------------------------*/
+type NetloggerHandle struct {
+	NetloggerPlugin
+	holder *pluginHolder
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Plugins that implement ConfigPlugin are passed their object from the
+ * plugins section of the settings file before they are started and again
+ * whenever the settings are changed while they are running.
+ */
+type ConfigPlugin interface {
+	Plugin
+	Configure(settings map[string]interface{})
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The pluginHolder tracks the state of each registered plugin. The running
+ * flag and the count of handlers in flight are atomic so a handler never
+ * waits for a lock, and a handler that hangs can not block the plugin from
+ * being stopped. The control lock is held while the plugin is configured,
+ * started, or stopped. Stopping clears the running flag so no new handlers
+ * are called and waits up to pluginStopWait for the handlers in flight to
+ * return before calling Goodbye.
+ *
+ * Each plugin gets its own childsync for the Add and Done calls it makes in
+ * Startup and Goodbye, and the daemon childsync is counted here instead, so
+ * a panic between those calls can not leave the daemon waiting forever.
+ */
+type pluginHolder struct {
+	plugin    Plugin
+	running   int32
+	inflight  int32
+	panics    int
+	control   sync.Mutex
+	counter   sync.Mutex
+	childsync *sync.WaitGroup
+}
+
+/*---------------------------------------------------------------------------*/
+func RegisterPlugin(plugin Plugin) {
+	holder := new(pluginHolder)
+	holder.plugin = plugin
+	pluginMutex.Lock()
+	pluginList = append(pluginList, holder)
+	pluginMutex.Unlock()
+	LogMessage("Plugin %s has been registered\n", plugin.Name())
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * StartPlugins starts every registered plugin that is enabled in the
+ * settings file. The childsync is saved so plugins can be started and
+ * stopped later when the settings are changed.
+ */
+func StartPlugins(childsync *sync.WaitGroup) {
+	pluginMutex.Lock()
+	pluginChildsync = childsync
+	pluginMutex.Unlock()
+	ApplyPluginSettings()
+}
+
+/*---------------------------------------------------------------------------*/
+func StopPlugins() {
+	for _, holder := range getHolders() {
+		stopPlugin(holder)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ApplyPluginSettings reads the plugins section of the settings file and
+ * starts, stops, or reconfigures each plugin to match. A plugin is enabled
+ * unless its settings object has enabled set to false.
+ */
+func ApplyPluginSettings() {
+	var section map[string]interface{}
+
+	settings, err := ReadSettingsFile()
+	if err != nil {
+		LogMessage("Unable to read plugin settings: %s\n", err)
+	} else if object, ok := settings.(map[string]interface{}); ok {
+		section, _ = object["plugins"].(map[string]interface{})
+	}
+
+	for _, holder := range getHolders() {
+		config, _ := section[holder.plugin.Name()].(map[string]interface{})
+		enabled := true
+		if value, ok := config["enabled"].(bool); ok {
+			enabled = value
+		}
+
+		if enabled {
+			startPlugin(holder, config)
+		} else {
+			stopPlugin(holder)
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func startPlugin(holder *pluginHolder, config map[string]interface{}) {
+	holder.control.Lock()
+	defer holder.control.Unlock()
+
+	if configurable, ok := holder.plugin.(ConfigPlugin); ok {
+		holder.configure(configurable, config)
+	}
+
+	if holder.isRunning() {
+		return
+	}
+
+	LogMessage("Plugin %s is starting\n", holder.plugin.Name())
+	holder.counter.Lock()
+	holder.panics = 0
+	holder.counter.Unlock()
+
+	holder.childsync = new(sync.WaitGroup)
+	pluginChildsync.Add(1)
+
+	// a plugin that fails to start is not running so it is not counted
+	defer func() {
+		if err := recover(); err != nil {
+			holder.handlePanic("Startup", err)
+			pluginChildsync.Done()
+		}
+	}()
+
+	holder.plugin.Startup(holder.childsync)
+	setRunning(holder, true)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * configure passes the settings to a plugin. A panic in Configure is only
+ * logged and counted so it can not take down the caller, which may be the
+ * settings handler in restd.
+ */
+func (holder *pluginHolder) configure(plugin ConfigPlugin, config map[string]interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			holder.handlePanic("Configure", err)
+		}
+	}()
+
+	plugin.Configure(config)
+}
+
+/*---------------------------------------------------------------------------*/
+func stopPlugin(holder *pluginHolder) {
+	holder.control.Lock()
+	defer holder.control.Unlock()
+
+	if !holder.isRunning() {
+		return
+	}
+
+	LogMessage("Plugin %s is stopping\n", holder.plugin.Name())
+	setRunning(holder, false)
+
+	// give the handlers that are still running a chance to finish
+	limit := time.Now().Add(pluginStopWait)
+	for (atomic.LoadInt32(&holder.inflight) != 0) && time.Now().Before(limit) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := atomic.LoadInt32(&holder.inflight); count != 0 {
+		LogMessage("Plugin %s is stopping with %d handlers still running\n", holder.plugin.Name(), count)
+		IncrementCounter("plugin." + holder.plugin.Name() + ".stop_timeout")
+	}
+
+	// the plugin is no longer counted even if Goodbye panics
+	defer pluginChildsync.Done()
+
+	defer func() {
+		if err := recover(); err != nil {
+			holder.handlePanic("Goodbye", err)
+		}
+	}()
+
+	holder.plugin.Goodbye(holder.childsync)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * handlePanic is called after a panic in a plugin has been recovered. It
+ * logs the stack, counts the failure, and returns true once the plugin has
+ * reached the panic limit. It must be called from the deferred function
+ * that called recover so the stack still shows where the panic happened.
+ */
+func (holder *pluginHolder) handlePanic(where string, err interface{}) bool {
+	name := holder.plugin.Name()
+	LogMessage("Plugin %s %s panic: %v\n%s", name, where, err, debug.Stack())
+	IncrementCounter("plugin." + name + ".panic")
+
+	holder.counter.Lock()
+	holder.panics++
+	limit := (holder.panics == pluginPanicLimit)
+	holder.counter.Unlock()
+
+	return (limit)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * disablePlugin stops a plugin that has reached the panic limit. The caller
+ * is a handler that is still in flight so we call stopPlugin from another
+ * goroutine where it can wait for the handler to return.
+ */
+func (holder *pluginHolder) disablePlugin() {
+	LogMessage("Plugin %s has been disabled after %d panics\n", holder.plugin.Name(), pluginPanicLimit)
+	IncrementCounter("plugin." + holder.plugin.Name() + ".disabled")
+	go stopPlugin(holder)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * enter is called before a plugin handler and returns false without
+ * counting the handler if the plugin is not running. The count is raised
+ * before the flag is checked and stopPlugin clears the flag before it
+ * checks the count, so either the handler sees the plugin stopped or
+ * stopPlugin sees the handler. The caller must call leave if enter returns
+ * true.
+ */
+func (holder *pluginHolder) enter() bool {
+	atomic.AddInt32(&holder.inflight, 1)
+	if holder.isRunning() {
+		return true
+	}
+	atomic.AddInt32(&holder.inflight, -1)
+	return false
+}
+
+/*---------------------------------------------------------------------------*/
+func (holder *pluginHolder) leave() {
+	atomic.AddInt32(&holder.inflight, -1)
+}
+
+/*---------------------------------------------------------------------------*/
+func (holder *pluginHolder) isRunning() bool {
+	return (atomic.LoadInt32(&holder.running) != 0)
+}
+
+/*---------------------------------------------------------------------------*/
+func getHolders() []*pluginHolder {
+	pluginMutex.Lock()
+	list := make([]*pluginHolder, len(pluginList))
+	copy(list, pluginList)
+	pluginMutex.Unlock()
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The list of running netfilter plugins is needed for every packet so we
+ * build it when a plugin is started or stopped rather than on every call,
+ * and store it atomically so reading it never waits for a lock. The caller
+ * must be holding the control lock for the holder.
+ */
+func setRunning(target *pluginHolder, running bool) {
+	var list []NetfilterHandle
+
+	pluginMutex.Lock()
+	defer pluginMutex.Unlock()
+
+	if running {
+		atomic.StoreInt32(&target.running, 1)
+	} else {
+		atomic.StoreInt32(&target.running, 0)
+	}
+
+	for _, holder := range pluginList {
+		if !holder.isRunning() {
+			continue
+		}
+		if handler, ok := holder.plugin.(NetfilterPlugin); ok {
+			list = append(list, NetfilterHandle{handler, holder})
+		}
+	}
+
+	netfilterList.Store(list)
+}
+
+/*---------------------------------------------------------------------------*/
+func GetPlugins() []Plugin {
+	var list []Plugin
+
+	for _, holder := range getHolders() {
+		if holder.isRunning() {
+			list = append(list, holder.plugin)
+		}
+	}
+
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+/*
+ * GetNetfilterPlugins returns the shared list of running netfilter plugins
+ * which must not be modified by the caller.
+ */
+func GetNetfilterPlugins() []NetfilterHandle {
+	list, _ := netfilterList.Load().([]NetfilterHandle)
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+func GetConntrackPlugins() []ConntrackHandle {
+	var list []ConntrackHandle
+
+	for _, holder := range getHolders() {
+		if !holder.isRunning() {
+			continue
+		}
+		if handler, ok := holder.plugin.(ConntrackPlugin); ok {
+			list = append(list, ConntrackHandle{handler, holder})
+		}
+	}
+
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+func GetNetloggerPlugins() []NetloggerHandle {
+	var list []NetloggerHandle
+
+	for _, holder := range getHolders() {
+		if !holder.isRunning() {
+			continue
+		}
+		if handler, ok := holder.plugin.(NetloggerPlugin); ok {
+			list = append(list, NetloggerHandle{handler, holder})
+		}
+	}
+
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * RunNetfilterHandler calls the netfilter handler for a plugin if it is
+ * still running. A plugin that has been stopped releases the session.
+ */
+func RunNetfilterHandler(handler NetfilterHandle, ctx *PacketContext) (verdict Verdict) {
+	holder := handler.holder
+	if !holder.enter() {
+		return (Verdict{Action: VerdictAccept, Release: true})
+	}
+	defer holder.leave()
+
+	// a panic in the handler returns the default verdict
+	defer func() {
+		if err := recover(); err != nil {
+			if holder.handlePanic("NetfilterHandler", err) {
+				holder.disablePlugin()
+			}
+			verdict = GetDefaultVerdict()
+		}
+	}()
+
+	return (handler.NetfilterHandler(ctx))
+}
+
+/*---------------------------------------------------------------------------*/
+func RunConntrackHandler(handler ConntrackHandle, message int, entry *ConntrackEntry) {
+	holder := handler.holder
+	if !holder.enter() {
+		return
+	}
+	defer holder.leave()
+
+	defer func() {
+		if err := recover(); err != nil {
+			if holder.handlePanic("ConntrackHandler", err) {
+				holder.disablePlugin()
+			}
+		}
+	}()
+
+	handler.ConntrackHandler(message, entry)
+}
+
+/*---------------------------------------------------------------------------*/
+func RunNetloggerHandler(handler NetloggerHandle, logger *Logger) {
+	holder := handler.holder
+	if !holder.enter() {
+		return
+	}
+	defer holder.leave()
+
+	defer func() {
+		if err := recover(); err != nil {
+			if holder.handlePanic("NetloggerHandler", err) {
+				holder.disablePlugin()
+			}
+		}
+	}()
+
+	handler.NetloggerHandler(logger)
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,143 @@
+package support
+
+import "sync"
+import "time"
+import "sync/atomic"
+import "testing"
+
+/*---------------------------------------------------------------------------*/
+type testPlugin struct {
+	name    string
+	release chan bool
+	panic   string
+}
+
+func (p *testPlugin) Name() string {
+	return (p.name)
+}
+
+func (p *testPlugin) Startup(childsync *sync.WaitGroup) {
+	childsync.Add(1)
+	if p.panic == "Startup" {
+		panic("startup failed")
+	}
+}
+
+func (p *testPlugin) Goodbye(childsync *sync.WaitGroup) {
+	if p.panic == "Goodbye" {
+		panic("goodbye failed")
+	}
+	childsync.Done()
+}
+
+func (p *testPlugin) NetfilterHandler(ctx *PacketContext) Verdict {
+	<-p.release
+	return (Verdict{Action: VerdictAccept})
+}
+
+func (p *testPlugin) Configure(settings map[string]interface{}) {
+	if p.panic == "Configure" {
+		panic("configure failed")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func startTestPlugin(t *testing.T, plugin Plugin, childsync *sync.WaitGroup) *pluginHolder {
+	RegisterPlugin(plugin)
+	list := getHolders()
+	holder := list[len(list)-1]
+	pluginChildsync = childsync
+	startPlugin(holder, nil)
+	return (holder)
+}
+
+/*---------------------------------------------------------------------------*/
+func TestStopPluginWithHungHandler(t *testing.T) {
+	var childsync sync.WaitGroup
+
+	Startup()
+	plugin := &testPlugin{name: "hung", release: make(chan bool)}
+	holder := startTestPlugin(t, plugin, &childsync)
+	handle := NetfilterHandle{plugin, holder}
+	defer close(plugin.release)
+
+	started := make(chan bool)
+	go func() {
+		close(started)
+		RunNetfilterHandler(handle, &PacketContext{})
+	}()
+	<-started
+
+	// wait for the handler to be in flight
+	for i := 0; (i < 100) && (atomic.LoadInt32(&holder.inflight) == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan bool)
+	go func() {
+		stopPlugin(holder)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(pluginStopWait + time.Second):
+		t.Fatalf("stopPlugin is blocked by a hung handler")
+	}
+
+	// handlers called after the stop return without calling the plugin
+	verdict := RunNetfilterHandler(handle, &PacketContext{})
+	if !verdict.Release {
+		t.Errorf("stopped plugin did not release the session")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestPluginPanicsKeepChildsyncBalanced(t *testing.T) {
+	var childsync sync.WaitGroup
+
+	Startup()
+	failed := &testPlugin{name: "startup-panic", panic: "Startup"}
+	holder := startTestPlugin(t, failed, &childsync)
+	if holder.isRunning() {
+		t.Errorf("plugin that panicked in Startup is running")
+	}
+
+	plugin := &testPlugin{name: "goodbye-panic", panic: "Goodbye"}
+	holder = startTestPlugin(t, plugin, &childsync)
+	stopPlugin(holder)
+
+	done := make(chan bool)
+	go func() {
+		childsync.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("childsync is not balanced after plugin panics")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestPluginPanicInConfigure(t *testing.T) {
+	var childsync sync.WaitGroup
+
+	Startup()
+	plugin := &testPlugin{name: "configure-panic", panic: "Configure"}
+	holder := startTestPlugin(t, plugin, &childsync)
+	defer stopPlugin(holder)
+
+	if GetCounters()["plugin.configure-panic.panic"] != 1 {
+		t.Errorf("the panic in Configure was not counted")
+	}
+
+	// changing the settings calls Configure again for the running plugin
+	startPlugin(holder, map[string]interface{}{"enabled": true})
+	if GetCounters()["plugin.configure-panic.panic"] != 2 {
+		t.Errorf("the second panic in Configure was not counted")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,124 @@
+package support
+
+import "os"
+import "fmt"
+import "sync"
+import "io/ioutil"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * QueueConfig holds the netfilter queue parameters that are passed to the
+ * C layer at startup. The values can come from command line flags or the
+ * netfilter section of the settings file and the effective values are
+ * available from the /status/netfilter REST call. The queue range is also
+ * written to QueueStateFile while the queues are open so the update_rules
+ * script sends traffic to the queues packetd is actually using.
+ */
+type QueueConfig struct {
+	QueueFirst  int
+	QueueCount  int
+	SockBuffer  int
+	QueueMaxlen int
+	NetBuffer   int
+}
+
+/*
+ * MaxQueueCount must match NETFILTER_MAX_QUEUES in netfilter.h
+ */
+const MaxQueueCount = 64
+
+// QueueStateFile is sourced by update_rules so it uses shell variable syntax
+const QueueStateFile = "/var/run/packetd.queue"
+
+var queueConfig QueueConfig
+var queueMutex sync.Mutex
+
+/*---------------------------------------------------------------------------*/
+func (config QueueConfig) Validate() error {
+	if (config.QueueCount < 1) || (config.QueueCount > MaxQueueCount) {
+		return fmt.Errorf("queue count %d must be between 1 and %d", config.QueueCount, MaxQueueCount)
+	}
+	if (config.QueueFirst < 0) || ((config.QueueFirst + config.QueueCount - 1) > 0xFFFF) {
+		return fmt.Errorf("queue %d with count %d is not a valid queue range", config.QueueFirst, config.QueueCount)
+	}
+	if (config.SockBuffer < 0) || (config.SockBuffer > 0x40000000) {
+		return fmt.Errorf("socket buffer %d must be between 0 and %d", config.SockBuffer, 0x40000000)
+	}
+	if (config.QueueMaxlen < 1) || (config.QueueMaxlen > 0x100000) {
+		return fmt.Errorf("queue maxlen %d must be between 1 and %d", config.QueueMaxlen, 0x100000)
+	}
+	if (config.NetBuffer < 2048) || (config.NetBuffer > 0x40000) {
+		return fmt.Errorf("net buffer %d must be between 2048 and %d", config.NetBuffer, 0x40000)
+	}
+	return nil
+}
+
+/*---------------------------------------------------------------------------*/
+func SetQueueConfig(config QueueConfig) {
+	queueMutex.Lock()
+	queueConfig = config
+	queueMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func GetQueueConfig() QueueConfig {
+	queueMutex.Lock()
+	config := queueConfig
+	queueMutex.Unlock()
+	return (config)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ReadQueueSettings returns the numeric values from the netfilter section
+ * of the settings file, for example {"netfilter": {"queue_count": 4}}. An
+ * empty map is returned if the file or the section does not exist.
+ */
+func ReadQueueSettings() map[string]int {
+	values := make(map[string]int)
+
+	settings, err := ReadSettingsFile()
+	if err != nil {
+		return (values)
+	}
+
+	object, _ := settings.(map[string]interface{})
+	section, _ := object["netfilter"].(map[string]interface{})
+
+	for name, item := range section {
+		if value, ok := item.(float64); ok {
+			values[name] = int(value)
+		} else {
+			LogMessage("Ignoring netfilter setting %s with non-numeric value %v\n", name, item)
+		}
+	}
+
+	return (values)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * WriteQueueState writes the queue range of the effective configuration to
+ * QueueStateFile. The file is written to a temporary name and renamed so
+ * update_rules never reads a partial file.
+ */
+func WriteQueueState() error {
+	config := GetQueueConfig()
+	state := fmt.Sprintf("PACKETD_QUEUE_NUM=%d\nPACKETD_QUEUE_COUNT=%d\n", config.QueueFirst, config.QueueCount)
+
+	err := ioutil.WriteFile(QueueStateFile+".tmp", []byte(state), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(QueueStateFile+".tmp", QueueStateFile)
+}
+
+/*---------------------------------------------------------------------------*/
+func RemoveQueueState() {
+	os.Remove(QueueStateFile)
+}
+
+/*---------------------------------------------------------------------------*/
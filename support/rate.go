@@ -0,0 +1,83 @@
+package support
+
+import "math"
+import "time"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Conntrack only gives us the total bytes for a connection, so the rates
+ * come from the change in the totals divided by the real time between the
+ * events. Events can be milliseconds or minutes apart, so each rate is an
+ * exponentially weighted moving average where the weight of a new sample
+ * depends on how much time it covers. The short rates follow changes within
+ * a few seconds and the long rates are closer to the average over a minute.
+ * All of the rates are in bytes per second.
+ */
+const RateShortWindow = 5 * time.Second
+const RateLongWindow = 60 * time.Second
+
+// events closer together than this are combined with the next one
+const rateMinInterval = 100 * time.Millisecond
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * UpdateCounters sets the byte counts from a conntrack event and updates
+ * the rates. It returns false without changing anything if either count
+ * went down, which means conntrack has a new connection with the same tuple
+ * and the caller should start a new entry.
+ */
+func (entry *ConntrackEntry) UpdateCounters(c2sBytes uint64, s2cBytes uint64, now time.Time) bool {
+	if (c2sBytes < entry.C2Sbytes) || (s2cBytes < entry.S2Cbytes) {
+		return false
+	}
+
+	entry.C2Sbytes = c2sBytes
+	entry.S2Cbytes = s2cBytes
+	entry.TotalBytes = (c2sBytes + s2cBytes)
+
+	// the first counts are where the rates start from
+	if entry.rateTime.IsZero() {
+		entry.rateTime = now
+		entry.rateC2Sbytes = c2sBytes
+		entry.rateS2Cbytes = s2cBytes
+		return true
+	}
+
+	elapsed := now.Sub(entry.rateTime)
+	if elapsed < rateMinInterval {
+		return true
+	}
+
+	seconds := elapsed.Seconds()
+	c2sSample := float64(c2sBytes-entry.rateC2Sbytes) / seconds
+	s2cSample := float64(s2cBytes-entry.rateS2Cbytes) / seconds
+
+	short := rateWeight(elapsed, RateShortWindow)
+	long := rateWeight(elapsed, RateLongWindow)
+
+	entry.C2Srate = rateAverage(entry.C2Srate, c2sSample, short)
+	entry.S2Crate = rateAverage(entry.S2Crate, s2cSample, short)
+	entry.TotalRate = (entry.C2Srate + entry.S2Crate)
+	entry.C2SrateLong = rateAverage(entry.C2SrateLong, c2sSample, long)
+	entry.S2CrateLong = rateAverage(entry.S2CrateLong, s2cSample, long)
+	entry.TotalRateLong = (entry.C2SrateLong + entry.S2CrateLong)
+
+	entry.rateTime = now
+	entry.rateC2Sbytes = c2sBytes
+	entry.rateS2Cbytes = s2cBytes
+	return true
+}
+
+/*---------------------------------------------------------------------------*/
+func rateWeight(elapsed time.Duration, window time.Duration) float64 {
+	return (1 - math.Exp(-elapsed.Seconds()/window.Seconds()))
+}
+
+/*---------------------------------------------------------------------------*/
+func rateAverage(current float32, sample float64, weight float64) float32 {
+	return float32(float64(current) + (weight * (sample - float64(current))))
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,70 @@
+package support
+
+import "math"
+import "reflect"
+import "time"
+import "testing"
+
+/*---------------------------------------------------------------------------*/
+func TestRateWeight(t *testing.T) {
+	if weight := rateWeight(0, RateShortWindow); weight != 0 {
+		t.Errorf("the weight with no elapsed time is %f", weight)
+	}
+	if weight := rateWeight(RateShortWindow, RateShortWindow); math.Abs(weight-(1-1/math.E)) > 1e-9 {
+		t.Errorf("the weight for one window is %f", weight)
+	}
+	if weight := rateWeight(time.Hour, RateShortWindow); weight < 0.999999 {
+		t.Errorf("the weight for a long gap is %f", weight)
+	}
+
+	// the long window always moves more slowly than the short window
+	for _, elapsed := range []time.Duration{rateMinInterval, time.Second, RateShortWindow, RateLongWindow} {
+		if rateWeight(elapsed, RateLongWindow) >= rateWeight(elapsed, RateShortWindow) {
+			t.Errorf("the long weight for %v is not below the short weight", elapsed)
+		}
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestUpdateCounters(t *testing.T) {
+	var entry ConntrackEntry
+	start := time.Now()
+
+	// the first counts are the starting point for the rates
+	if !entry.UpdateCounters(1000, 2000, start) || (entry.TotalBytes != 3000) || (entry.C2Srate != 0) {
+		t.Fatalf("the first update gave %+v", entry)
+	}
+
+	// counts closer together than the minimum interval do not change the rate
+	if !entry.UpdateCounters(1100, 2000, start.Add(rateMinInterval/2)) || (entry.C2Srate != 0) || (entry.C2Sbytes != 1100) {
+		t.Errorf("the short interval update gave %+v", entry)
+	}
+
+	later := start.Add(time.Second)
+	if !entry.UpdateCounters(6000, 2000, later) {
+		t.Fatalf("the counts going up was seen as a new connection")
+	}
+
+	expected := 5000 * rateWeight(time.Second, RateShortWindow)
+	if math.Abs(float64(entry.C2Srate)-expected) > 0.01 {
+		t.Errorf("the short rate is %f instead of %f", entry.C2Srate, expected)
+	}
+	expected = 5000 * rateWeight(time.Second, RateLongWindow)
+	if math.Abs(float64(entry.C2SrateLong)-expected) > 0.01 {
+		t.Errorf("the long rate is %f instead of %f", entry.C2SrateLong, expected)
+	}
+	if (entry.S2Crate != 0) || (entry.TotalRate != entry.C2Srate) {
+		t.Errorf("the reply rate is %f and the total is %f", entry.S2Crate, entry.TotalRate)
+	}
+
+	// counts that go down mean a new connection and nothing is changed
+	saved := entry
+	if entry.UpdateCounters(10, 2000, later.Add(time.Second)) {
+		t.Errorf("the counts going down was not seen as a new connection")
+	}
+	if !reflect.DeepEqual(entry, saved) {
+		t.Errorf("the entry was changed by counts that went down")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,110 @@
+package support
+
+import "time"
+import "sync/atomic"
+import "crypto/x509"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * BypassMark is the connmark bit that tells the rules installed by
+ * update_rules to stop sending a session to the netfilter queue. We set
+ * it once every plugin has released the session.
+ */
+const BypassMark uint32 = 0x10000000
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Subscribe adds a plugin to the list of plugins that want to see the
+ * packets for a session. Every netfilter plugin is subscribed when a new
+ * session is created.
+ */
+func (entry *SessionEntry) Subscribe(name string) {
+	entry.subscriptionMutex.Lock()
+	if entry.subscriptions == nil {
+		entry.subscriptions = make(map[string]bool)
+	}
+	entry.subscriptions[name] = true
+	entry.subscriptionMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Release removes a plugin from the list of plugins that want to see the
+ * packets for a session and returns the number of subscriptions remaining.
+ */
+func (entry *SessionEntry) Release(name string) int {
+	entry.subscriptionMutex.Lock()
+	delete(entry.subscriptions, name)
+	count := len(entry.subscriptions)
+	entry.subscriptionMutex.Unlock()
+	return (count)
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) IsSubscribed(name string) bool {
+	entry.subscriptionMutex.Lock()
+	status := entry.subscriptions[name]
+	entry.subscriptionMutex.Unlock()
+	return (status)
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) SubscriptionCount() int {
+	entry.subscriptionMutex.Lock()
+	count := len(entry.subscriptions)
+	entry.subscriptionMutex.Unlock()
+	return (count)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The handlers for different packets of a session can run at the same time,
+ * so the values plugins store in the session are only accessed through
+ * functions that hold the attribute mutex.
+ */
+func (entry *SessionEntry) SetLocations(client string, server string) {
+	entry.attributeMutex.Lock()
+	entry.clientLocation = client
+	entry.serverLocation = server
+	entry.attributeMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) GetLocations() (string, string) {
+	entry.attributeMutex.Lock()
+	client := entry.clientLocation
+	server := entry.serverLocation
+	entry.attributeMutex.Unlock()
+	return client, server
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) SetServerCertificate(cert x509.Certificate) {
+	entry.attributeMutex.Lock()
+	entry.serverCertificate = cert
+	entry.attributeMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) GetServerCertificate() x509.Certificate {
+	entry.attributeMutex.Lock()
+	cert := entry.serverCertificate
+	entry.attributeMutex.Unlock()
+	return (cert)
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) SetActivity(when time.Time) {
+	atomic.StoreInt64(&entry.activity, when.UnixNano())
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) GetActivity() time.Time {
+	return (time.Unix(0, atomic.LoadInt64(&entry.activity)))
+}
+
+/*---------------------------------------------------------------------------*/
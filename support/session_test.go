@@ -0,0 +1,121 @@
+package support
+
+import "net"
+import "sync"
+import "time"
+import "testing"
+
+/*---------------------------------------------------------------------------*/
+func testTuple() Tuple {
+	return Tuple{Protocol: 6, ClientAddr: net.ParseIP("10.0.0.1").To4(), ClientPort: 40000, ServerAddr: net.ParseIP("10.0.0.2").To4(), ServerPort: 443}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestSessionActivity(t *testing.T) {
+	var wg sync.WaitGroup
+
+	Startup()
+	session, _ := FindOrCreateSession(testTuple())
+	start := time.Now()
+
+	// the queues and the conntrack thread all touch the same session
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				session.SetActivity(time.Now())
+				session.SetLocations("US", "CA")
+				session.GetLocations()
+			}
+		}()
+	}
+
+	CleanSessionTable()
+	wg.Wait()
+
+	if session.GetActivity().Before(start) {
+		t.Errorf("activity %v is before %v", session.GetActivity(), start)
+	}
+	if client, server := session.GetLocations(); (client != "US") || (server != "CA") {
+		t.Errorf("locations are %s and %s", client, server)
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestCleanSessionTable(t *testing.T) {
+	Startup()
+	tuple := testTuple()
+	session, _ := FindOrCreateSession(tuple)
+	session.SetActivity(time.Now().Add(-time.Hour))
+
+	// an idle session is kept while conntrack still has the flow
+	InsertConntrackEntry(Tuple2String(tuple), ConntrackEntry{SessionId: session.SessionId, SessionTuple: tuple})
+	CleanSessionTable()
+	if _, ok := FindSessionTuple(tuple); !ok {
+		t.Fatalf("session was removed while conntrack has the flow")
+	}
+
+	RemoveConntrackEntry(Tuple2String(tuple))
+	CleanSessionTable()
+	if _, ok := FindSessionTuple(tuple); ok {
+		t.Fatalf("idle session was not removed")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestFindOrCreateNatSession(t *testing.T) {
+	Startup()
+	tuple := Tuple{Protocol: 6, ClientAddr: net.ParseIP("10.0.0.1").To4(), ClientPort: 40000, ServerAddr: net.ParseIP("203.0.113.1").To4(), ServerPort: 8080}
+	packet := Tuple{Protocol: 6, ClientAddr: net.ParseIP("10.0.0.1").To4(), ClientPort: 40000, ServerAddr: net.ParseIP("192.168.1.5").To4(), ServerPort: 80}
+
+	// the packet path sees the port forward after DNAT
+	session, _ := FindOrCreateSession(packet)
+
+	found, ok := FindOrCreateNatSession(tuple, packet)
+	if !ok || (found != session) {
+		t.Fatalf("conntrack did not find the session created by the packets")
+	}
+	if found, ok = FindSessionTuple(ReverseTuple(tuple)); !ok || (found != session) {
+		t.Errorf("the session is not found with the original tuple")
+	}
+
+	if !RemoveSessionId(session.SessionId, tuple, packet) {
+		t.Fatalf("the session was not removed")
+	}
+	if _, ok = FindSessionTuple(tuple); ok {
+		t.Errorf("the session is still found with the original tuple")
+	}
+	if _, ok = FindSessionTuple(packet); ok {
+		t.Errorf("the session is still found with the packet tuple")
+	}
+
+	// a session created by conntrack is found by the packets
+	session, ok = FindOrCreateNatSession(tuple, packet)
+	if ok || !session.SessionTuple.ClientAddr.Equal(tuple.ClientAddr) || (session.SessionTuple.ServerPort != 8080) {
+		t.Errorf("the new session is %+v", session.SessionTuple)
+	}
+	if found, ok = FindSessionTuple(ReverseTuple(packet)); !ok || (found != session) {
+		t.Errorf("the packets do not find the session created by conntrack")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
+func TestRemoveSessionId(t *testing.T) {
+	Startup()
+	tuple := testTuple()
+	session, _ := FindOrCreateSession(tuple)
+
+	// an old session ID never removes the session now using the tuple
+	if RemoveSessionId(session.SessionId-1, tuple) {
+		t.Errorf("a session with another ID was removed")
+	}
+	if _, ok := FindSessionTuple(tuple); !ok {
+		t.Fatalf("the session is gone")
+	}
+	if !RemoveSessionId(session.SessionId, ReverseTuple(tuple)) {
+		t.Errorf("the session was not removed with the reverse tuple")
+	}
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,27 @@
+package support
+
+import "io/ioutil"
+import "encoding/json"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * SettingsFile is the JSON settings file managed by the REST daemon.
+ */
+const SettingsFile = "/etc/config/settings.json"
+
+/*---------------------------------------------------------------------------*/
+func ReadSettingsFile() (interface{}, error) {
+	raw, err := ioutil.ReadFile(SettingsFile)
+	if err != nil {
+		return nil, err
+	}
+	var jsonObject interface{}
+	err = json.Unmarshal(raw, &jsonObject)
+	if err != nil {
+		return nil, err
+	}
+	return jsonObject, nil
+}
+
+/*---------------------------------------------------------------------------*/
@@ -0,0 +1,112 @@
+package support
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Plugins that implement StreamPlugin can subscribe to the reassembled TCP
+ * byte streams for a session by calling SubscribeStream, usually from the
+ * netfilter handler for the first packet so the stream starts with the SYN.
+ * The handler is called with the bytes for each direction in order. Skipped
+ * is set when data was lost before the bytes in Data, either because it was
+ * never seen or because the plugin fell behind, and the last call for each
+ * direction has Closed set. Data is only valid until the handler returns.
+ * A session is never bypassed while it has stream subscribers, so plugins
+ * should call ReleaseStream as soon as they have seen enough.
+ */
+type StreamPlugin interface {
+	Plugin
+	StreamHandler(stream *StreamData)
+}
+
+/*---------------------------------------------------------------------------*/
+type StreamHandle struct {
+	StreamPlugin
+	holder *pluginHolder
+}
+
+/*---------------------------------------------------------------------------*/
+type StreamData struct {
+	Session        *SessionEntry
+	ClientToServer bool
+	Data           []byte
+	Skipped        bool
+	Closed         bool
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) SubscribeStream(name string) {
+	entry.subscriptionMutex.Lock()
+	if entry.streams == nil {
+		entry.streams = make(map[string]bool)
+	}
+	entry.streams[name] = true
+	entry.subscriptionMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) ReleaseStream(name string) int {
+	entry.subscriptionMutex.Lock()
+	delete(entry.streams, name)
+	count := len(entry.streams)
+	entry.subscriptionMutex.Unlock()
+	return (count)
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) IsStreamSubscribed(name string) bool {
+	entry.subscriptionMutex.Lock()
+	status := entry.streams[name]
+	entry.subscriptionMutex.Unlock()
+	return (status)
+}
+
+/*---------------------------------------------------------------------------*/
+func (entry *SessionEntry) StreamCount() int {
+	entry.subscriptionMutex.Lock()
+	count := len(entry.streams)
+	entry.subscriptionMutex.Unlock()
+	return (count)
+}
+
+/*---------------------------------------------------------------------------*/
+func GetStreamPlugins() []StreamHandle {
+	var list []StreamHandle
+
+	for _, holder := range getHolders() {
+		if !holder.isRunning() {
+			continue
+		}
+		if handler, ok := holder.plugin.(StreamPlugin); ok {
+			list = append(list, StreamHandle{handler, holder})
+		}
+	}
+
+	return (list)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * RunStreamHandler calls the stream handler for a plugin if it is still
+ * running. A plugin that has been stopped releases the stream.
+ */
+func RunStreamHandler(handler StreamHandle, stream *StreamData) {
+	holder := handler.holder
+	if !holder.enter() {
+		stream.Session.ReleaseStream(handler.Name())
+		return
+	}
+	defer holder.leave()
+
+	defer func() {
+		if err := recover(); err != nil {
+			if holder.handlePanic("StreamHandler", err) {
+				holder.disablePlugin()
+			}
+		}
+	}()
+
+	handler.StreamHandler(stream)
+}
+
+/*---------------------------------------------------------------------------*/
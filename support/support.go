@@ -7,7 +7,7 @@ import "sync"
 import "crypto/x509"
 
 var runtime time.Time
-var sessionTable map[string]SessionEntry
+var sessionTable map[string]*SessionEntry
 var conntrackTable map[string]ConntrackEntry
 var certificateTable map[string]CertificateHolder
 var certificateMutex sync.Mutex
@@ -25,31 +25,72 @@ type Tuple struct {
 }
 
 /*---------------------------------------------------------------------------*/
+
+/*
+ * There is one SessionEntry for each flow, created by FindOrCreateSession
+ * for the first packet or FindOrCreateNatSession for the first conntrack
+ * event, whichever comes first, and removed when conntrack destroys the
+ * flow. The conntrack entry for the flow has the same SessionId so plugins
+ * see one ID from both sources. The activity time is written by every queue
+ * and the conntrack thread so it is stored as atomic nanoseconds and
+ * accessed with SetActivity and GetActivity.
+ */
 type SessionEntry struct {
 	SessionId         uint64
+	activity          int64
 	SessionCreation   time.Time
-	SessionActivity   time.Time
 	SessionTuple      Tuple
 	UpdateCount       uint64
-	ServerCertificate x509.Certificate
-	ClientLocation    string
-	ServerLocation    string
+	C2Spackets        uint64
+	S2Cpackets        uint64
+	C2Sbytes          uint64
+	S2Cbytes          uint64
+	serverCertificate x509.Certificate
+	clientLocation    string
+	serverLocation    string
+	subscriptions     map[string]bool
+	streams           map[string]bool
+	subscriptionMutex sync.Mutex
+	attributeMutex    sync.Mutex
 }
 
 /*---------------------------------------------------------------------------*/
+
+/*
+ * The SessionTuple is the conntrack original direction and the ReplyTuple
+ * is the reply direction, which has the addresses and ports after NAT. The
+ * Status is the conntrack IPS_ status bits, the TCPState is the conntrack
+ * TCP state for TCP, and the Timeout is the seconds left before conntrack
+ * expires the entry. The packet and byte counts are only set when conntrack
+ * accounting is enabled, and the rates are updated by UpdateCounters.
+ */
 type ConntrackEntry struct {
 	SessionId       uint64
 	SessionCreation time.Time
 	SessionActivity time.Time
 	SessionTuple    Tuple
+	ReplyTuple      Tuple
 	UpdateCount     uint64
+	C2Spackets      uint64
+	S2Cpackets      uint64
 	C2Sbytes        uint64
 	S2Cbytes        uint64
 	TotalBytes      uint64
 	C2Srate         float32
 	S2Crate         float32
 	TotalRate       float32
+	C2SrateLong     float32
+	S2CrateLong     float32
+	TotalRateLong   float32
+	ConnMark        uint32
+	Zone            uint16
+	Status          uint32
+	TCPState        uint8
+	Timeout         uint32
 	PurgeFlag       bool
+	rateTime        time.Time
+	rateC2Sbytes    uint64
+	rateS2Cbytes    uint64
 }
 
 /*---------------------------------------------------------------------------*/
@@ -58,8 +99,8 @@ type Logger struct {
 	IcmpType uint16
 	SrcIntf  uint8
 	DstIntf  uint8
-	SrcAddr  uint32
-	DstAddr  uint32
+	SrcAddr  net.IP
+	DstAddr  net.IP
 	SrcPort  uint16
 	DstPort  uint16
 	Mark     uint32
@@ -79,9 +120,12 @@ func Startup() {
 
 	// create the conntrack, session, and certificate tables
 	conntrackTable = make(map[string]ConntrackEntry)
-	sessionTable = make(map[string]SessionEntry)
+	sessionTable = make(map[string]*SessionEntry)
 	certificateTable = make(map[string]CertificateHolder)
 
+	// reserve the packet mark fields used by the system
+	markStartup()
+
 	// initialize the sessionIndex counter
 	// highest 16 bits are zero
 	// middle  32 bits should be epoch
@@ -116,10 +160,43 @@ func Int2Ip(value uint32) net.IP {
 
 /*---------------------------------------------------------------------------*/
 func Tuple2String(tuple Tuple) string {
+	// IPv6 addresses are wrapped in brackets to separate them from the port
+	if tuple.ClientAddr.To4() == nil {
+		retval := fmt.Sprintf("%d|[%s]:%d-[%s]:%d", tuple.Protocol, tuple.ClientAddr, tuple.ClientPort, tuple.ServerAddr, tuple.ServerPort)
+		return (retval)
+	}
+
 	retval := fmt.Sprintf("%d|%s:%d-%s:%d", tuple.Protocol, tuple.ClientAddr, tuple.ClientPort, tuple.ServerAddr, tuple.ServerPort)
 	return (retval)
 }
 
+/*---------------------------------------------------------------------------*/
+
+/*
+ * CopyTuple returns a tuple with its own copy of the addresses, which must
+ * be used for any tuple built from a borrowed packet buffer that is kept.
+ */
+func CopyTuple(tuple Tuple) Tuple {
+	tuple.ClientAddr = append(net.IP(nil), tuple.ClientAddr...)
+	tuple.ServerAddr = append(net.IP(nil), tuple.ServerAddr...)
+	return (tuple)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * ReverseTuple returns the tuple for packets going the other direction.
+ */
+func ReverseTuple(tuple Tuple) Tuple {
+	var reverse Tuple
+	reverse.Protocol = tuple.Protocol
+	reverse.ClientAddr = tuple.ServerAddr
+	reverse.ClientPort = tuple.ServerPort
+	reverse.ServerAddr = tuple.ClientAddr
+	reverse.ServerPort = tuple.ClientPort
+	return (reverse)
+}
+
 /*---------------------------------------------------------------------------*/
 func NextSessionId() uint64 {
 	var value uint64
@@ -136,7 +213,7 @@ func NextSessionId() uint64 {
 }
 
 /*---------------------------------------------------------------------------*/
-func FindSessionEntry(finder string) (SessionEntry, bool) {
+func FindSessionEntry(finder string) (*SessionEntry, bool) {
 	sessionMutex.Lock()
 	entry, status := sessionTable[finder]
 	sessionMutex.Unlock()
@@ -144,12 +221,196 @@ func FindSessionEntry(finder string) (SessionEntry, bool) {
 }
 
 /*---------------------------------------------------------------------------*/
-func InsertSessionEntry(finder string, entry SessionEntry) {
+func InsertSessionEntry(finder string, entry *SessionEntry) {
 	sessionMutex.Lock()
 	sessionTable[finder] = entry
 	sessionMutex.Unlock()
 }
 
+/*---------------------------------------------------------------------------*/
+
+/*
+ * FindOrInsertSessionEntry returns the existing entry and true if there is
+ * one, otherwise it inserts the entry and returns it and false. Packets for
+ * the same session can arrive on more than one queue at the same time, so
+ * this must be used to add new sessions instead of FindSessionEntry followed
+ * by InsertSessionEntry.
+ */
+func FindOrInsertSessionEntry(finder string, entry *SessionEntry) (*SessionEntry, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if current, status := sessionTable[finder]; status {
+		return current, true
+	}
+
+	sessionTable[finder] = entry
+	return entry, false
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Sessions are keyed by the tuple in the client to server direction, which
+ * is the conntrack original direction, so FindSessionTuple looks for the
+ * packet tuple both ways. Compare the tuple with the SessionTuple of the
+ * entry to find the direction of the packet.
+ */
+func FindSessionTuple(tuple Tuple) (*SessionEntry, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	return findSessionTuple(tuple)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * FindOrInsertSessionTuple is like FindOrInsertSessionEntry but looks for
+ * the packet tuple in both directions and inserts the entry using the key
+ * for its SessionTuple.
+ */
+func FindOrInsertSessionTuple(tuple Tuple, entry *SessionEntry) (*SessionEntry, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if current, status := findSessionTuple(tuple); status {
+		return current, true
+	}
+
+	sessionTable[Tuple2String(entry.SessionTuple)] = entry
+	return entry, false
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * FindOrCreateSession returns the session for a tuple in either direction
+ * and true, or creates a session with the tuple as the SessionTuple and
+ * returns it and false. Every netfilter plugin is subscribed to a new
+ * session.
+ */
+func FindOrCreateSession(tuple Tuple) (*SessionEntry, bool) {
+	if entry, status := FindSessionTuple(tuple); status {
+		return entry, true
+	}
+
+	// another queue or the conntrack thread may have added it since we looked
+	return FindOrInsertSessionTuple(tuple, newSession(tuple))
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * FindOrCreateNatSession is FindOrCreateSession for conntrack, which also
+ * knows the packet tuple, the original tuple after DNAT. Packets are queued
+ * after DNAT, so for a port forward the packet path creates the session
+ * with the packet tuple. The session is found with either tuple, and is
+ * added to the table with both so the packets and the conntrack events for
+ * the flow always share it. A new session has the original tuple.
+ */
+func FindOrCreateNatSession(tuple Tuple, packetTuple Tuple) (*SessionEntry, bool) {
+	if entry, status := findNatSession(tuple, packetTuple, nil); status {
+		return entry, true
+	}
+
+	// the packet path may have added it since we looked
+	return findNatSession(tuple, packetTuple, newSession(tuple))
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * findNatSession looks for the session with either tuple and adds it with
+ * the tuples that do not already find a session. The created session is
+ * used when neither tuple finds one, and nothing is added if it is nil.
+ */
+func findNatSession(tuple Tuple, packetTuple Tuple, created *SessionEntry) (*SessionEntry, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	entry, status := findSessionTuple(tuple)
+	if !status {
+		entry, status = findSessionTuple(packetTuple)
+	}
+	if !status {
+		if created == nil {
+			return nil, false
+		}
+		entry = created
+	}
+
+	for _, item := range []Tuple{tuple, packetTuple} {
+		if _, found := findSessionTuple(item); !found {
+			sessionTable[Tuple2String(item)] = entry
+		}
+	}
+
+	return entry, status
+}
+
+/*---------------------------------------------------------------------------*/
+func newSession(tuple Tuple) *SessionEntry {
+	entry := new(SessionEntry)
+	entry.SessionId = NextSessionId()
+	entry.SessionCreation = time.Now()
+	entry.SetActivity(entry.SessionCreation)
+	entry.SessionTuple = CopyTuple(tuple)
+	for _, handler := range GetNetfilterPlugins() {
+		entry.Subscribe(handler.Name())
+	}
+	return (entry)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * RemoveSessionTuple removes the session for a tuple in either direction
+ * and returns it.
+ */
+func RemoveSessionTuple(tuple Tuple) (*SessionEntry, bool) {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	entry, status := findSessionTuple(tuple)
+	if status {
+		delete(sessionTable, Tuple2String(entry.SessionTuple))
+	}
+	return entry, status
+}
+
+/*---------------------------------------------------------------------------*/
+func findSessionTuple(tuple Tuple) (*SessionEntry, bool) {
+	if entry, status := sessionTable[Tuple2String(tuple)]; status {
+		return entry, true
+	}
+	entry, status := sessionTable[Tuple2String(ReverseTuple(tuple))]
+	return entry, status
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * RemoveSessionId removes the session with the ID from the table for each
+ * tuple in either direction. A tuple can be reused as soon as conntrack is
+ * done with it, so a session for a new flow with the same tuple is kept.
+ */
+func RemoveSessionId(id uint64, tuples ...Tuple) bool {
+	var removed bool
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	for _, tuple := range tuples {
+		for _, finder := range []string{Tuple2String(tuple), Tuple2String(ReverseTuple(tuple))} {
+			if entry, status := sessionTable[finder]; status && (entry.SessionId == id) {
+				delete(sessionTable, finder)
+				removed = true
+			}
+		}
+	}
+	return (removed)
+}
+
 /*---------------------------------------------------------------------------*/
 func RemoveSessionEntry(finder string) {
 	sessionMutex.Lock()
@@ -158,23 +419,47 @@ func RemoveSessionEntry(finder string) {
 }
 
 /*---------------------------------------------------------------------------*/
+
+/*
+ * Sessions are normally removed by the conntrack destroy event, so this
+ * only removes idle sessions that conntrack is not tracking, such as those
+ * for packets that were dropped before conntrack confirmed the flow. The
+ * conntrack mutex is taken while holding the session mutex, so the session
+ * mutex must never be taken while holding the conntrack mutex.
+ */
 func CleanSessionTable() {
 	var counter int = 0
 	nowtime := time.Now()
 
-	for key, val := range conntrackTable {
-		if val.PurgeFlag == false {
+	sessionMutex.Lock()
+	for key, val := range sessionTable {
+		if nowtime.Sub(val.GetActivity()) < (600 * time.Second) {
 			continue
 		}
-		if (nowtime.Unix() - val.SessionActivity.Unix()) < 60 {
+		if conntrackActive(val.SessionTuple) {
 			continue
 		}
-		RemoveSessionEntry(key)
+		delete(sessionTable, key)
 		counter++
 		LogMessage("SESSION Removing %s from table\n", key)
 	}
+	remaining := len(sessionTable)
+	sessionMutex.Unlock()
+
+	LogMessage("SESSION REMOVED:%d REMAINING:%d\n", counter, remaining)
+}
+
+/*---------------------------------------------------------------------------*/
+func conntrackActive(tuple Tuple) bool {
+	conntrackMutex.Lock()
+	defer conntrackMutex.Unlock()
 
-	LogMessage("SESSION REMOVED:%d REMAINING:%d\n", counter, len(sessionTable))
+	for _, finder := range []string{Tuple2String(tuple), Tuple2String(ReverseTuple(tuple))} {
+		if entry, status := conntrackTable[finder]; status && !entry.PurgeFlag {
+			return true
+		}
+	}
+	return false
 }
 
 /*---------------------------------------------------------------------------*/
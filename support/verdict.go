@@ -0,0 +1,115 @@
+package support
+
+import "fmt"
+import "sync"
+import "strings"
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * The verdict actions are ordered by precedence. When the results from
+ * several plugins are combined, the action with the highest value wins,
+ * so a single plugin asking to drop a packet overrides every accept.
+ */
+type VerdictAction int
+
+const (
+	VerdictAccept VerdictAction = iota
+	VerdictRepeat
+	VerdictReject
+	VerdictDrop
+)
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * Verdict is returned by plugin netfilter handlers. Only the bits of Mark
+ * that are also set in Mask are applied to the packet mark, which lets each
+ * plugin manage its own bits without clearing those set by others. A plugin
+ * sets Release when it no longer needs to see packets for the session.
+ * A plugin that wants to change the packet returns the complete rewritten
+ * IP packet in Packet, usually created with BuildPacket.
+ */
+type Verdict struct {
+	Action  VerdictAction
+	Mark    uint32
+	Mask    uint32
+	Release bool
+	Packet  []byte
+}
+
+/*
+ * The default verdict is used in place of the verdict from a plugin handler
+ * that times out or panics, so a broken plugin can never stall the queue.
+ */
+var defaultVerdict = Verdict{Action: VerdictAccept}
+var defaultMutex sync.Mutex
+
+/*---------------------------------------------------------------------------*/
+func SetDefaultVerdict(verdict Verdict) {
+	defaultMutex.Lock()
+	defaultVerdict = verdict
+	defaultMutex.Unlock()
+}
+
+/*---------------------------------------------------------------------------*/
+func GetDefaultVerdict() Verdict {
+	defaultMutex.Lock()
+	verdict := defaultVerdict
+	defaultMutex.Unlock()
+	return (verdict)
+}
+
+/*---------------------------------------------------------------------------*/
+func (action VerdictAction) String() string {
+	switch action {
+	case VerdictAccept:
+		return ("ACCEPT")
+	case VerdictRepeat:
+		return ("REPEAT")
+	case VerdictReject:
+		return ("REJECT")
+	case VerdictDrop:
+		return ("DROP")
+	}
+	return (fmt.Sprintf("VERDICT_%d", int(action)))
+}
+
+/*---------------------------------------------------------------------------*/
+func ParseVerdictAction(name string) (VerdictAction, error) {
+	switch strings.ToUpper(name) {
+	case "ACCEPT":
+		return VerdictAccept, nil
+	case "REPEAT":
+		return VerdictRepeat, nil
+	case "REJECT":
+		return VerdictReject, nil
+	case "DROP":
+		return VerdictDrop, nil
+	}
+	return VerdictAccept, fmt.Errorf("invalid verdict action: %s", name)
+}
+
+/*---------------------------------------------------------------------------*/
+
+/*
+ * MergeVerdict combines a plugin verdict with the current packet verdict.
+ * The action with the higher precedence is kept and the masked mark bits
+ * from the plugin are applied on top of the current mark. Only one packet
+ * rewrite can be applied so the first one is kept.
+ */
+func MergeVerdict(current Verdict, update Verdict) Verdict {
+	if update.Action > current.Action {
+		current.Action = update.Action
+	}
+
+	if current.Packet == nil {
+		current.Packet = update.Packet
+	}
+
+	current.Mark = (current.Mark &^ update.Mask) | (update.Mark & update.Mask)
+	current.Mask |= update.Mask
+	return (current)
+}
+
+/*---------------------------------------------------------------------------*/